@@ -0,0 +1,53 @@
+package srvDiscover
+
+import "context"
+
+type LeaseID int64
+
+// NoLease put时不绑定lease
+const NoLease LeaseID = 0
+
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+type KeyValue struct {
+	Key         []byte
+	Value       []byte
+	ModRevision int64
+	Lease       LeaseID
+}
+
+type Event struct {
+	Type EventType
+	Kv   KeyValue
+}
+
+type WatchResponse struct {
+	Events   []Event
+	Revision int64 //本次响应对应的存储revision
+	Err      error //不为nil时watch已经失效, channel随后关闭
+}
+
+// Backend 注册中心存储的抽象, Register/Subscribe/license只通过此接口访问存储
+// 默认实现为EtcdBackend, 其它存储或者测试用的内存实现可以通过Repo.WithBackend替换
+type Backend interface {
+	// Grant 创建ttlSec秒的lease
+	Grant(ctx context.Context, ttlSec int64) (LeaseID, error)
+	// KeepAlive 持续续约直到ctx结束, 每次续约成功channel收到一次, lease失效或者连接断开时channel关闭
+	KeepAlive(ctx context.Context, id LeaseID) (<-chan struct{}, error)
+	Revoke(ctx context.Context, id LeaseID) error
+	// Put lease为NoLease时不绑定lease, 返回写入后的revision
+	Put(ctx context.Context, key, value string, lease LeaseID) (int64, error)
+	Delete(ctx context.Context, key string) error
+	// GetPrefix 返回前缀下的所有kv和读取时的revision
+	GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error)
+	// WatchPrefix 从revision开始watch前缀, revision<=0表示从当前开始, ctx结束或者出错时channel关闭
+	WatchPrefix(ctx context.Context, prefix string, revision int64) <-chan WatchResponse
+	// Ping 检查存储是否可用
+	Ping(ctx context.Context) error
+	Close() error
+}
@@ -0,0 +1,87 @@
+package srvDiscover
+
+import (
+	"fmt"
+	"github.com/xukgo/gsaber/utils/randomUtil"
+	"strings"
+)
+
+const (
+	BALANCER_RANDOM          = "random"
+	BALANCER_ROUNDROBIN      = "roundrobin"
+	BALANCER_WEIGHTED        = "weighted"
+	BALANCER_CONSISTENT_HASH = "consistenthash"
+	BALANCER_P2C             = "p2c"
+)
+
+// BalancerConf 订阅服务的选择策略, 例如:
+// <Balancer type="weighted" cpu="1" memory="1" />
+// <Balancer type="consistenthash" replicas="160" />
+type BalancerConf struct {
+	Type     string `xml:"type,attr"`     //random, roundrobin, weighted, consistenthash, p2c, 默认为roundrobin
+	Replicas int    `xml:"replicas,attr"` //consistenthash的虚拟节点数, 默认160
+	//weighted各负载项的占比, 都为0时使用DefaultProfileWeights
+	Cpu    float64 `xml:"cpu,attr"`
+	IO     float64 `xml:"io,attr"`
+	Disk   float64 `xml:"disk,attr"`
+	Memory float64 `xml:"memory,attr"`
+	Socket float64 `xml:"socket,attr"`
+}
+
+// 反序列化后的处理, 检查type
+func (this *BalancerConf) fill() error {
+	this.Type = strings.ToLower(strings.TrimSpace(this.Type))
+	if len(this.Type) == 0 {
+		this.Type = BALANCER_ROUNDROBIN
+	}
+	_, err := this.NewPicker()
+	return err
+}
+
+// NewPicker 按配置创建Picker
+func (this *BalancerConf) NewPicker() (Picker, error) {
+	switch this.Type {
+	case BALANCER_RANDOM:
+		return NewRandomPicker(), nil
+	case "", BALANCER_ROUNDROBIN:
+		return NewRoundRobinPicker(), nil
+	case BALANCER_WEIGHTED:
+		weights := ProfileWeights{
+			Cpu:    this.Cpu,
+			IO:     this.IO,
+			Disk:   this.Disk,
+			Memory: this.Memory,
+			Socket: this.Socket,
+		}
+		if weights == (ProfileWeights{}) {
+			weights = DefaultProfileWeights
+		}
+		return NewWeightedPicker(weights), nil
+	case BALANCER_CONSISTENT_HASH:
+		return NewConsistentHashPicker(this.Replicas), nil
+	case BALANCER_P2C:
+		return NewP2CPicker(), nil
+	}
+	return nil, fmt.Errorf("unknown balancer type %s", this.Type)
+}
+
+// RandomPicker 随机选择
+type RandomPicker struct {
+}
+
+func NewRandomPicker() *RandomPicker {
+	return new(RandomPicker)
+}
+
+func (this *RandomPicker) Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo {
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes[randomUtil.NewInt32(0, int32(len(nodes)))]
+}
+
+// Pick 按服务配置的Balancer(或SetPicker设置的Picker)选择一个节点
+// hint传给Picker, 例如consistenthash使用hint作为hash的key
+func (this *Repo) Pick(name string, hint string) (RegisterInfo, bool) {
+	return this.pick(name, hint)
+}
@@ -0,0 +1,66 @@
+package srvDiscover
+
+import (
+	"testing"
+)
+
+func Test_FillWithXmlBalancer(t *testing.T) {
+	xmlContent := `<SrvDiscover>
+    <Subscribe>
+        <Service>
+            <Name>svc</Name>
+            <Balancer type=" ConsistentHash " replicas="10" />
+        </Service>
+        <Service>
+            <Name>weighted</Name>
+            <Balancer type="weighted" cpu="2" />
+        </Service>
+        <Service>
+            <Name>plain</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+	conf := new(ConfRoot)
+	err := conf.FillWithXml([]byte(xmlContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pickers, err := conf.getSubscribePickers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pickers) != 2 {
+		t.Fatalf("unexpected picker count %d", len(pickers))
+	}
+	hashPicker, ok := pickers["svc"].(*ConsistentHashPicker)
+	if !ok || hashPicker.replicas != 10 {
+		t.Fatalf("unexpected picker %T", pickers["svc"])
+	}
+	if _, ok = pickers["weighted"].(*WeightedPicker); !ok {
+		t.Fatalf("unexpected picker %T", pickers["weighted"])
+	}
+
+	repo := new(Repo)
+	repo.subsNodeCache = map[string]*SubSrvNodeList{"svc": newTestNodeList("n1", "n2", "n3")}
+	err = repo.SetPicker("svc", pickers["svc"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, ok := repo.Pick("svc", "call-1")
+	if !ok {
+		t.Fatal("pick failed")
+	}
+	for i := 0; i < 10; i++ {
+		info, _ := repo.Pick("svc", "call-1")
+		if info.Global.NodeId != first.Global.NodeId {
+			t.Fatal("same hint picked different nodes")
+		}
+	}
+
+	conf = new(ConfRoot)
+	err = conf.FillWithXml([]byte(`<SrvDiscover><Subscribe><Service><Name>svc</Name><Balancer type="unknown" /></Service></Subscribe></SrvDiscover>`))
+	if err == nil {
+		t.Fatal("expect error for unknown balancer type")
+	}
+}
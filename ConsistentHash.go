@@ -0,0 +1,132 @@
+package srvDiscover
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// 每个节点在hash环上的虚拟节点数
+const DEFAULT_HASH_REPLICAS = 160
+
+type hashRingNode struct {
+	hash uint32
+	id   string //节点的CacheUniqueId, 即RegisterInfo.UniqueId()
+}
+
+// ConsistentHashPicker 按hint做一致性hash, 相同的hint落到同一个节点
+// 节点增删时只有落在该节点虚拟节点区间的key会迁移; hint为空时选择环上的第一个节点
+type ConsistentHashPicker struct {
+	replicas int
+
+	locker  sync.RWMutex
+	members []string //构建hash环时的节点id, 与nodes相同时复用
+	ring    []hashRingNode
+}
+
+func NewConsistentHashPicker(replicas int) *ConsistentHashPicker {
+	if replicas <= 0 {
+		replicas = DEFAULT_HASH_REPLICAS
+	}
+	model := new(ConsistentHashPicker)
+	model.replicas = replicas
+	return model
+}
+
+func (this *ConsistentHashPicker) Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo {
+	return this.pickExcept(nodes, hint, nil)
+}
+
+// 沿hash环跳过exclude中的节点, 重试时使用完整的nodes, hash环不需要重建
+func (this *ConsistentHashPicker) pickExcept(nodes []*SrvNodeInfo, hint string, exclude map[string]bool) *SrvNodeInfo {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	ring := this.getRing(nodes)
+	hash := crc32.ChecksumIEEE([]byte(hint))
+	idx := sort.Search(len(ring), func(i int) bool {
+		return ring[i].hash >= hash
+	})
+
+	for i := 0; i < len(ring); i++ {
+		id := ring[(idx+i)%len(ring)].id
+		if exclude[id] {
+			continue
+		}
+		n := sort.Search(len(nodes), func(i int) bool {
+			return nodes[i].CacheUniqueId >= id
+		})
+		if n < len(nodes) && nodes[n].CacheUniqueId == id {
+			return nodes[n]
+		}
+		return nil
+	}
+	return nil
+}
+
+// 节点没有变化时复用已有的hash环
+func (this *ConsistentHashPicker) getRing(nodes []*SrvNodeInfo) []hashRingNode {
+	this.locker.RLock()
+	if sameMembers(this.members, nodes) {
+		ring := this.ring
+		this.locker.RUnlock()
+		return ring
+	}
+	this.locker.RUnlock()
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if sameMembers(this.members, nodes) {
+		return this.ring
+	}
+
+	members := make([]string, 0, len(nodes))
+	ring := make([]hashRingNode, 0, len(nodes)*this.replicas)
+	for _, info := range nodes {
+		members = append(members, info.CacheUniqueId)
+		for i := 0; i < this.replicas; i++ {
+			hash := crc32.ChecksumIEEE([]byte(strconv.Itoa(i) + info.CacheUniqueId))
+			ring = append(ring, hashRingNode{hash: hash, id: info.CacheUniqueId})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash == ring[j].hash {
+			return ring[i].id < ring[j].id
+		}
+		return ring[i].hash < ring[j].hash
+	})
+	this.members = members
+	this.ring = ring
+	return ring
+}
+
+func sameMembers(members []string, nodes []*SrvNodeInfo) bool {
+	if len(members) != len(nodes) {
+		return false
+	}
+	for idx := range nodes {
+		if members[idx] != nodes[idx].CacheUniqueId {
+			return false
+		}
+	}
+	return true
+}
+
+// GetServiceByHashKey 按key做一致性hash选择online节点, 例如使用呼叫id保持呼叫的亲和性
+// 与服务设置的Picker无关
+func (this *Repo) GetServiceByHashKey(name string, key string) (bool, RegisterInfo) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	srvNodeList := this.getSubsNodeList(name)
+	if srvNodeList == nil || srvNodeList.hashPicker == nil {
+		return false, RegisterInfo{}
+	}
+	info := srvNodeList.hashPicker.Pick(srvNodeList.pickNodes, key)
+	if info == nil {
+		return false, RegisterInfo{}
+	}
+	return true, info.RegInfo.DeepClone(false)
+}
@@ -0,0 +1,186 @@
+package srvDiscover
+
+import (
+	"fmt"
+	jsoniter "github.com/json-iterator/go"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DebugInfo repo当前状态的快照, 由DebugHandler以JSON输出
+type DebugInfo struct {
+	Time           time.Time               `json:"time"`
+	Closed         bool                    `json:"closed"`
+	RegisterEnable bool                    `json:"registerEnable"`
+	Registrations  []DebugRegistrationInfo `json:"registrations"`
+	Subscriptions  []DebugSubscriptionInfo `json:"subscriptions"`
+	License        *DebugLicenseInfo       `json:"license"`
+}
+
+type DebugRegistrationInfo struct {
+	Key        string     `json:"key"`
+	Name       string     `json:"name"`
+	NodeId     string     `json:"nodeId"`
+	Version    string     `json:"version"`
+	State      string     `json:"state"`
+	LeaseGroup string     `json:"leaseGroup"`
+	LastSaved  *time.Time `json:"lastSaved,omitempty"`
+	LastError  string     `json:"lastError,omitempty"`
+}
+
+type DebugSubscriptionInfo struct {
+	Name      string          `json:"name"`
+	Version   string          `json:"version"`
+	Namespace string          `json:"namespace"`
+	Revision  int64           `json:"revision"`
+	Synced    bool            `json:"synced"`
+	Picker    string          `json:"picker"`
+	Watch     WatchStatusInfo `json:"watch"`
+	Nodes     []DebugNodeInfo `json:"nodes"`
+}
+
+type DebugNodeInfo struct {
+	CacheUniqueId string                  `json:"cacheUniqueId"`
+	ModRevision   int64                   `json:"modRevision"`
+	NodeId        string                  `json:"nodeId"`
+	State         string                  `json:"state"`
+	Version       string                  `json:"version"`
+	PrivateIp     string                  `json:"privateIP"`
+	PublicIP      string                  `json:"publicIP"`
+	Zone          string                  `json:"zone,omitempty"`
+	Region        string                  `json:"region,omitempty"`
+	SvcInfos      []RegisterSvcDefineConf `json:"svcInfos"`
+	Profile       RegisterProfileInfo     `json:"profile"`
+	InFlight      int64                   `json:"inflight"`
+	EjectedUntil  *time.Time              `json:"ejectedUntil,omitempty"`
+}
+
+type DebugLicenseInfo struct {
+	Revision int64          `json:"revision"`
+	Info     *LicResultInfo `json:"info"`
+}
+
+// DebugInfo 收集注册、订阅和许可的状态, 只使用读锁
+func (this *Repo) DebugInfo() DebugInfo {
+	now := this.now()
+	info := DebugInfo{
+		Time:          now,
+		Registrations: make([]DebugRegistrationInfo, 0),
+		Subscriptions: make([]DebugSubscriptionInfo, 0),
+	}
+
+	this.lifeLocker.Lock()
+	info.Closed = this.closed
+	this.lifeLocker.Unlock()
+	if this.registerEnable != nil {
+		info.RegisterEnable = this.registerEnable.Load()
+	}
+
+	for _, reg := range this.Registrations() {
+		info.Registrations = append(info.Registrations, reg.debugInfo())
+	}
+
+	this.locker.RLock()
+	for _, srvNodeList := range this.subsNodeCache {
+		info.Subscriptions = append(info.Subscriptions, srvNodeList.debugInfo(now))
+	}
+	this.locker.RUnlock()
+	sort.Slice(info.Subscriptions, func(i, j int) bool {
+		return info.Subscriptions[i].Name < info.Subscriptions[j].Name
+	})
+
+	this.licLocker.RLock()
+	if this.subLicResultInfo != nil {
+		info.License = &DebugLicenseInfo{Revision: this.subLicResultInfo.Reversion}
+		if this.subLicResultInfo.Info != nil {
+			info.License.Info = this.subLicResultInfo.Info.Clone()
+		}
+	}
+	this.licLocker.RUnlock()
+	return info
+}
+
+// 只读取status, etcd无响应或者BeforeRegister阻塞时也能立即返回
+func (this *Registration) debugInfo() DebugRegistrationInfo {
+	this.statusLocker.Lock()
+	status := this.status
+	this.statusLocker.Unlock()
+
+	info := DebugRegistrationInfo{
+		Key:        status.key,
+		Name:       status.global.Name,
+		NodeId:     status.global.NodeId,
+		Version:    status.global.Version,
+		State:      this.state.get(),
+		LeaseGroup: this.group.name,
+		LastSaved:  optionalTime(status.timeSaved),
+	}
+	if status.lastErr != nil {
+		info.LastError = status.lastErr.Error()
+	}
+	return info
+}
+
+// 调用方需要持有locker
+func (this *SubSrvNodeList) debugInfo(now time.Time) DebugSubscriptionInfo {
+	info := DebugSubscriptionInfo{
+		Name:      this.Name,
+		Version:   this.Version,
+		Namespace: this.Namespace,
+		Revision:  this.Revision,
+		Watch:     this.watchStatus.snapshot(),
+		Nodes:     make([]DebugNodeInfo, 0, len(this.NodeInfos)),
+	}
+	if this.synced != nil {
+		select {
+		case <-this.synced:
+			info.Synced = true
+		default:
+		}
+	}
+	if this.picker != nil {
+		info.Picker = fmt.Sprintf("%T", this.picker)
+	}
+
+	for _, node := range this.NodeInfos {
+		global := node.RegInfo.Global
+		nodeInfo := DebugNodeInfo{
+			CacheUniqueId: node.CacheUniqueId,
+			ModRevision:   node.ModRevision,
+			NodeId:        global.NodeId,
+			State:         global.State,
+			Version:       global.Version,
+			PrivateIp:     global.PrivateIp,
+			PublicIP:      global.PublicIP,
+			Zone:          global.Zone,
+			Region:        global.Region,
+			SvcInfos:      node.RegInfo.SvcInfos,
+			Profile:       node.RegInfo.Profile,
+			InFlight:      node.InFlight(),
+		}
+		if ejectedUntil := node.health.ejectedUntilTime(); ejectedUntil.After(now) {
+			nodeInfo.EjectedUntil = &ejectedUntil
+		}
+		info.Nodes = append(info.Nodes, nodeInfo)
+	}
+	return info
+}
+
+// DebugHandler 以JSON输出DebugInfo, 可以挂在已有的管理端口上, 只使用读锁
+func (this *Repo) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := jsoniter.ConfigCompatibleWithStandardLibrary.MarshalIndent(this.DebugInfo(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(data)
+	})
+}
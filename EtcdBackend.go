@@ -0,0 +1,150 @@
+package srvDiscover
+
+import (
+	"context"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// EtcdBackend 基于etcd v3的Backend实现
+type EtcdBackend struct {
+	client *clientv3.Client
+}
+
+func NewEtcdBackend(client *clientv3.Client) *EtcdBackend {
+	return &EtcdBackend{client: client}
+}
+
+func (this *EtcdBackend) Client() *clientv3.Client {
+	return this.client
+}
+
+func (this *EtcdBackend) Grant(ctx context.Context, ttlSec int64) (LeaseID, error) {
+	resp, err := this.client.Grant(ctx, ttlSec)
+	if err != nil {
+		return NoLease, err
+	}
+	return LeaseID(resp.ID), nil
+}
+
+func (this *EtcdBackend) KeepAlive(ctx context.Context, id LeaseID) (<-chan struct{}, error) {
+	keepaliveChan, err := this.client.KeepAlive(ctx, clientv3.LeaseID(id))
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan struct{}, 1)
+	go func() {
+		defer close(out)
+		//recv nil或者channel关闭, lease已经失效
+		for resp := range keepaliveChan {
+			if resp == nil {
+				return
+			}
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (this *EtcdBackend) Revoke(ctx context.Context, id LeaseID) error {
+	_, err := this.client.Revoke(ctx, clientv3.LeaseID(id))
+	return err
+}
+
+func (this *EtcdBackend) Put(ctx context.Context, key, value string, lease LeaseID) (int64, error) {
+	var opts []clientv3.OpOption
+	if lease != NoLease {
+		opts = append(opts, clientv3.WithLease(clientv3.LeaseID(lease)))
+	}
+	resp, err := this.client.Put(ctx, key, value, opts...)
+	if err != nil {
+		return 0, err
+	}
+	return resp.Header.Revision, nil
+}
+
+func (this *EtcdBackend) Delete(ctx context.Context, key string) error {
+	_, err := this.client.Delete(ctx, key)
+	return err
+}
+
+func (this *EtcdBackend) GetPrefix(ctx context.Context, prefix string) ([]KeyValue, int64, error) {
+	resp, err := this.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, 0, err
+	}
+
+	list := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		list = append(list, convertEtcdKv(kv))
+	}
+	return list, resp.Header.Revision, nil
+}
+
+func (this *EtcdBackend) WatchPrefix(ctx context.Context, prefix string, revision int64) <-chan WatchResponse {
+	opts := []clientv3.OpOption{clientv3.WithPrefix()}
+	if revision > 0 {
+		opts = append(opts, clientv3.WithRev(revision))
+	}
+	watchChan := this.client.Watch(clientv3.WithRequireLeader(ctx), prefix, opts...)
+
+	out := make(chan WatchResponse)
+	go func() {
+		defer close(out)
+		for watchResponse := range watchChan {
+			resp := WatchResponse{
+				Revision: watchResponse.Header.Revision,
+				Err:      watchResponse.Err(),
+			}
+			if resp.Err == nil {
+				resp.Events = make([]Event, 0, len(watchResponse.Events))
+				for _, event := range watchResponse.Events {
+					resp.Events = append(resp.Events, convertEtcdEvent(event))
+				}
+			}
+
+			select {
+			case out <- resp:
+			case <-ctx.Done():
+				return
+			}
+			if resp.Err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+func (this *EtcdBackend) Ping(ctx context.Context) error {
+	_, err := this.client.MemberList(ctx)
+	return err
+}
+
+func (this *EtcdBackend) Close() error {
+	return this.client.Close()
+}
+
+func convertEtcdKv(kv *mvccpb.KeyValue) KeyValue {
+	return KeyValue{
+		Key:         kv.Key,
+		Value:       kv.Value,
+		ModRevision: kv.ModRevision,
+		Lease:       LeaseID(kv.Lease),
+	}
+}
+
+func convertEtcdEvent(event *clientv3.Event) Event {
+	model := Event{Kv: convertEtcdKv(event.Kv)}
+	switch event.Type {
+	case mvccpb.PUT:
+		model.Type = EventPut
+	case mvccpb.DELETE:
+		model.Type = EventDelete
+	}
+	return model
+}
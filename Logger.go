@@ -0,0 +1,40 @@
+package srvDiscover
+
+import (
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+// 结构化日志的字段名
+const (
+	LOG_KEY_SERVICE     = "service"
+	LOG_KEY_NODE_ID     = "nodeId"
+	LOG_KEY_KEY         = "key"
+	LOG_KEY_REVISION    = "revision"
+	LOG_KEY_ERROR       = "error"
+	LOG_KEY_NAMESPACE   = "namespace"
+	LOG_KEY_LEASE_GROUP = "leaseGroup"
+)
+
+// DiscardLogger 丢弃所有日志, 用于WithLogger静默repo
+var DiscardLogger = slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+
+// repo使用的日志, 没有设置时跟随slog.Default()
+type repoLogger struct {
+	value atomic.Pointer[slog.Logger]
+}
+
+// WithLogger 设置repo使用的日志, 为nil时恢复为slog.Default()
+// 可以在运行中调用, 之后的日志使用新的logger
+func (this *Repo) WithLogger(logger *slog.Logger) {
+	this.logger.value.Store(logger)
+}
+
+func (this *Repo) log() *slog.Logger {
+	logger := this.logger.value.Load()
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
@@ -0,0 +1,247 @@
+package srvDiscover
+
+import (
+	"sync"
+	"time"
+)
+
+// OutlierOption 本地剔除异常节点的策略, 通过Repo.ReportResult上报调用结果
+// ConsecutiveFailures和FailureRate都为0时关闭剔除
+type OutlierOption struct {
+	ConsecutiveFailures int           //连续失败次数达到该值时剔除
+	FailureRate         float64       //统计周期内失败率达到该值时剔除, 0-1
+	MinRequests         int           //统计周期内请求数不少于该值时才按失败率剔除
+	Interval            time.Duration //失败率的统计周期
+	BaseEjectionTime    time.Duration //第一次剔除的时长, 之后每次连续剔除翻倍
+	MaxEjectionTime     time.Duration //剔除时长的上限
+	MaxEjectedPercent   int           //同一服务最多剔除的online节点百分比, 0-100
+}
+
+var defaultOutlierOption = OutlierOption{
+	ConsecutiveFailures: 5,
+	FailureRate:         0.5,
+	MinRequests:         20,
+	Interval:            10 * time.Second,
+	BaseEjectionTime:    30 * time.Second,
+	MaxEjectionTime:     5 * time.Minute,
+	MaxEjectedPercent:   50,
+}
+
+func (this *OutlierOption) enabled() bool {
+	return this.ConsecutiveFailures > 0 || this.FailureRate > 0
+}
+
+// 节点的调用统计和剔除状态, 节点从缓存删除时一并丢弃
+// 剔除到期后节点重新可选(半开), 此时的第一次失败会以翻倍的时长再次剔除, 第一次成功则恢复正常
+type nodeHealth struct {
+	locker       sync.Mutex
+	consecutive  int
+	windowStart  time.Time
+	requests     int
+	failures     int
+	ejectCount   int //连续剔除的次数, 恢复正常后清零
+	ejectedUntil time.Time
+}
+
+func (this *nodeHealth) ejected(now time.Time) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	return now.Before(this.ejectedUntil)
+}
+
+// 记录一次调用结果, 返回是否需要剔除
+func (this *nodeHealth) record(failed bool, now time.Time, option *OutlierOption) bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	//剔除期间的结果来自剔除前发出的请求, 不参与统计
+	if now.Before(this.ejectedUntil) {
+		return false
+	}
+	if now.Sub(this.windowStart) >= option.Interval {
+		this.windowStart = now
+		this.requests = 0
+		this.failures = 0
+	}
+	this.requests++
+
+	probing := this.ejectCount > 0
+	if !failed {
+		this.consecutive = 0
+		this.ejectCount = 0
+		return false
+	}
+	this.failures++
+	this.consecutive++
+
+	if probing {
+		return true
+	}
+	if option.ConsecutiveFailures > 0 && this.consecutive >= option.ConsecutiveFailures {
+		return true
+	}
+	if option.FailureRate > 0 && this.requests >= option.MinRequests &&
+		float64(this.failures) >= option.FailureRate*float64(this.requests) {
+		return true
+	}
+	return false
+}
+
+// 剔除节点, 返回剔除时长
+func (this *nodeHealth) eject(now time.Time, option *OutlierOption) time.Duration {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	duration := option.BaseEjectionTime
+	for i := 0; i < this.ejectCount && duration < option.MaxEjectionTime; i++ {
+		duration *= 2
+	}
+	duration = min(duration, option.MaxEjectionTime)
+
+	this.ejectCount++
+	this.ejectedUntil = now.Add(duration)
+	this.consecutive = 0
+	this.requests = 0
+	this.failures = 0
+	return duration
+}
+
+// SetOutlierOption 设置异常节点的剔除策略, 零值表示关闭
+func (this *Repo) SetOutlierOption(option OutlierOption) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.outlierOption = &option
+}
+
+// 调用方需要持有locker
+func (this *Repo) getOutlierOption() *OutlierOption {
+	if this.outlierOption == nil {
+		return &defaultOutlierOption
+	}
+	return this.outlierOption
+}
+
+// ReportResult 上报一次对节点的调用结果, err为nil表示成功, nodeId为RegisterGlobalInfo.NodeId
+// 失败达到OutlierOption的条件时节点在本地被剔除, 剔除期间不会被Get*和Picker选中
+func (this *Repo) ReportResult(service string, nodeId string, err error) {
+	now := this.now()
+
+	this.locker.RLock()
+	option := this.getOutlierOption()
+	srvNodeList := this.getSubsNodeList(service)
+	node := findNodeById(srvNodeList, nodeId)
+	shouldEject := option.enabled() && node != nil && node.health.record(err != nil, now, option)
+	this.locker.RUnlock()
+	if !shouldEject {
+		return
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	//期间节点可能已经被删除, 或者其它协程已经剔除到上限
+	if this.getSubsNodeList(service) != srvNodeList || findNodeById(srvNodeList, nodeId) != node {
+		return
+	}
+	if !srvNodeList.canEject(now, option) {
+		return
+	}
+	duration := node.health.eject(now, option)
+	srvNodeList.refreshPickNodes(now)
+	this.scheduleEjectionRefresh(service, srvNodeList, now, duration)
+}
+
+// 剔除到期时执行的刷新
+type ejectionRefresh struct {
+	at      time.Time
+	refresh func()
+}
+
+// 剔除到期后重新加入可选节点, 定时器在Close时停止, 调用方需要持有locker写锁
+func (this *Repo) scheduleEjectionRefresh(service string, srvNodeList *SubSrvNodeList, now time.Time, duration time.Duration) {
+	this.lifeLocker.Lock()
+	closed := this.closed
+	this.lifeLocker.Unlock()
+	if closed {
+		return
+	}
+
+	refresh := func() {
+		if this.getSubsNodeList(service) == srvNodeList {
+			srvNodeList.refreshPickNodes(this.now())
+		}
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(duration, func() {
+		this.locker.Lock()
+		defer this.locker.Unlock()
+
+		//已经被Close停止
+		if _, ok := this.ejectTimers[timer]; !ok {
+			return
+		}
+		delete(this.ejectTimers, timer)
+		refresh()
+	})
+	if this.ejectTimers == nil {
+		this.ejectTimers = make(map[*time.Timer]ejectionRefresh)
+	}
+	this.ejectTimers[timer] = ejectionRefresh{at: now.Add(duration), refresh: refresh}
+}
+
+func (this *Repo) now() time.Time {
+	if this.clock != nil {
+		return this.clock()
+	}
+	return time.Now()
+}
+
+// 停止所有剔除到期的定时器
+func (this *Repo) stopEjectionTimers() {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	for timer := range this.ejectTimers {
+		timer.Stop()
+	}
+	this.ejectTimers = nil
+}
+
+func findNodeById(srvNodeList *SubSrvNodeList, nodeId string) *SrvNodeInfo {
+	if srvNodeList == nil {
+		return nil
+	}
+	for _, info := range srvNodeList.NodeInfos {
+		if info.RegInfo.Global.NodeId == nodeId {
+			return info
+		}
+	}
+	return nil
+}
+
+// 剔除后被剔除的online节点占比不超过MaxEjectedPercent, 调用方需要持有locker
+func (this *SubSrvNodeList) canEject(now time.Time, option *OutlierOption) bool {
+	online := 0
+	ejected := 0
+	for _, info := range this.NodeInfos {
+		if !isNodeOnline(info) {
+			continue
+		}
+		online++
+		if info.health.ejected(now) {
+			ejected++
+		}
+	}
+	return (ejected+1)*100 <= option.MaxEjectedPercent*online
+}
+
+// 节点是否可用: online并且没有被剔除
+func isNodeAvailable(info *SrvNodeInfo, now time.Time) bool {
+	return isNodeOnline(info) && !info.health.ejected(now)
+}
+
+func (this *nodeHealth) ejectedUntilTime() time.Time {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	return this.ejectedUntil
+}
@@ -0,0 +1,162 @@
+package srvDiscover
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// 推进repo的时钟并执行已到期的剔除刷新, 真实的定时器时长足够长, 测试期间不会触发
+func advanceEjectionClock(repo *Repo, now *time.Time, d time.Duration) {
+	repo.locker.Lock()
+	defer repo.locker.Unlock()
+
+	*now = now.Add(d)
+	for timer, item := range repo.ejectTimers {
+		if item.at.After(*now) {
+			continue
+		}
+		timer.Stop()
+		delete(repo.ejectTimers, timer)
+		item.refresh()
+	}
+}
+
+func Test_ReportResultEjection(t *testing.T) {
+	now := time.Now()
+	repo := new(Repo)
+	repo.clock = func() time.Time { return now }
+	repo.subsNodeCache = map[string]*SubSrvNodeList{"svc": newTestNodeList("n1", "n2", "n3")}
+	repo.SetOutlierOption(OutlierOption{
+		ConsecutiveFailures: 2,
+		Interval:            time.Hour,
+		BaseEjectionTime:    time.Minute,
+		MaxEjectionTime:     time.Hour,
+		MaxEjectedPercent:   50,
+	})
+	failed := fmt.Errorf("failed")
+
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 3 {
+		t.Fatal("ejected before reaching consecutive failures")
+	}
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("node not ejected after consecutive failures")
+	}
+	for i := 0; i < 10; i++ {
+		if info, _ := repo.Next("svc"); info.Global.NodeId == "n1" {
+			t.Fatal("ejected node picked")
+		}
+	}
+	if ok, _ := repo.GetServiceByNameAndNodeId("svc", "n1"); ok {
+		t.Fatal("ejected node returned by id")
+	}
+
+	//超过MaxEjectedPercent时不再剔除
+	repo.ReportResult("svc", "n2", failed)
+	repo.ReportResult("svc", "n2", failed)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("ejected over max percent")
+	}
+
+	//到期后半开, 第一次失败立即以翻倍的时长再次剔除
+	advanceEjectionClock(repo, &now, time.Minute)
+	if len(repo.GetServiceByName("svc")) != 3 {
+		t.Fatal("node not restored after ejection time")
+	}
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("probing failure not ejected")
+	}
+	advanceEjectionClock(repo, &now, time.Minute+time.Second)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("second ejection not doubled")
+	}
+	advanceEjectionClock(repo, &now, time.Minute)
+
+	//半开成功后恢复正常, 需要重新达到连续失败才剔除
+	repo.ReportResult("svc", "n1", nil)
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 3 {
+		t.Fatal("node ejected after recovery")
+	}
+	repo.locker.RLock()
+	pickCount := len(repo.subsNodeCache["svc"].pickNodes)
+	repo.locker.RUnlock()
+	if pickCount != 3 {
+		t.Fatalf("pick nodes not restored: %d", pickCount)
+	}
+}
+
+func Test_ReportResultFailureRate(t *testing.T) {
+	repo := new(Repo)
+	repo.subsNodeCache = map[string]*SubSrvNodeList{"svc": newTestNodeList("n1", "n2")}
+	repo.SetOutlierOption(OutlierOption{
+		FailureRate:       0.5,
+		MinRequests:       4,
+		Interval:          time.Minute,
+		BaseEjectionTime:  time.Minute,
+		MaxEjectionTime:   time.Minute,
+		MaxEjectedPercent: 50,
+	})
+
+	failed := fmt.Errorf("failed")
+	repo.ReportResult("svc", "n1", failed)
+	repo.ReportResult("svc", "n1", nil)
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("ejected before min requests")
+	}
+	repo.ReportResult("svc", "n1", nil)
+	if len(repo.GetServiceByName("svc")) != 2 {
+		t.Fatal("ejected on success")
+	}
+	repo.ReportResult("svc", "n1", failed)
+	if len(repo.GetServiceByName("svc")) != 1 {
+		t.Fatal("node not ejected by failure rate")
+	}
+}
+
+func Test_CloseStopsEjectionTimers(t *testing.T) {
+	repo := new(Repo)
+	repo.subsNodeCache = map[string]*SubSrvNodeList{"svc": newTestNodeList("n1", "n2", "n3", "n4")}
+	repo.SetOutlierOption(OutlierOption{
+		ConsecutiveFailures: 1,
+		Interval:            time.Minute,
+		BaseEjectionTime:    50 * time.Millisecond,
+		MaxEjectionTime:     time.Second,
+		MaxEjectedPercent:   50,
+	})
+	repo.ReportResult("svc", "n1", fmt.Errorf("failed"))
+	repo.locker.RLock()
+	timerCount := len(repo.ejectTimers)
+	repo.locker.RUnlock()
+	if timerCount != 1 {
+		t.Fatalf("expect 1 ejection timer, got %d", timerCount)
+	}
+
+	err := repo.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//定时器已停止, 到期后不会刷新可选节点
+	time.Sleep(100 * time.Millisecond)
+	repo.locker.RLock()
+	pickCount := len(repo.subsNodeCache["svc"].pickNodes)
+	timerCount = len(repo.ejectTimers)
+	repo.locker.RUnlock()
+	if pickCount != 3 || timerCount != 0 {
+		t.Fatalf("timer fired after close, pick nodes:%d timers:%d", pickCount, timerCount)
+	}
+
+	//Close后不再创建定时器
+	repo.ReportResult("svc", "n2", fmt.Errorf("failed"))
+	repo.locker.RLock()
+	timerCount = len(repo.ejectTimers)
+	repo.locker.RUnlock()
+	if timerCount != 0 {
+		t.Fatalf("timer created after close: %d", timerCount)
+	}
+}
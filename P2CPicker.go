@@ -0,0 +1,83 @@
+package srvDiscover
+
+import (
+	"math/rand"
+)
+
+// P2CPicker 随机取两个节点, 选择进行中请求较少的一个
+// 请求数由使用方通过Repo.Acquire/Release上报, 没有上报时退化为随机选择
+type P2CPicker struct {
+}
+
+func NewP2CPicker() *P2CPicker {
+	return new(P2CPicker)
+}
+
+func (this *P2CPicker) Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo {
+	count := len(nodes)
+	if count == 0 {
+		return nil
+	}
+	if count == 1 {
+		return nodes[0]
+	}
+
+	first := rand.Intn(count)
+	second := rand.Intn(count - 1)
+	if second >= first {
+		second++
+	}
+	if nodes[second].InFlight() < nodes[first].InFlight() {
+		return nodes[second]
+	}
+	return nodes[first]
+}
+
+// Acquire 开始一个发往该节点的请求, 必须与Release成对调用
+// 节点按服务名和RegisterInfo.UniqueId()查找, 不在订阅缓存里时忽略
+func (this *Repo) Acquire(info RegisterInfo) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	node := this.findSubsNode(info.Global.Name, info.UniqueId())
+	if node != nil {
+		node.inflight.Add(1)
+	}
+}
+
+// Release 结束一个通过Acquire记录的请求
+func (this *Repo) Release(info RegisterInfo) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	node := this.findSubsNode(info.Global.Name, info.UniqueId())
+	if node == nil {
+		return
+	}
+	for {
+		value := node.inflight.Load()
+		if value <= 0 || node.inflight.CompareAndSwap(value, value-1) {
+			return
+		}
+	}
+}
+
+// 先在同名的订阅里查找, 找不到时查找所有订阅, 调用方需要持有locker
+func (this *Repo) findSubsNode(name string, uniqueId string) *SrvNodeInfo {
+	srvNodeList := this.getSubsNodeList(name)
+	if srvNodeList != nil {
+		for _, info := range srvNodeList.NodeInfos {
+			if info.CacheUniqueId == uniqueId {
+				return info
+			}
+		}
+	}
+	for _, srvNodeList := range this.subsNodeCache {
+		for _, info := range srvNodeList.NodeInfos {
+			if info.CacheUniqueId == uniqueId {
+				return info
+			}
+		}
+	}
+	return nil
+}
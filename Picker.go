@@ -0,0 +1,173 @@
+package srvDiscover
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/gsaber/utils/stringUtil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Picker 从订阅服务的可用节点中选择一个
+// nodes只包含online并且没有被剔除的节点(设置了Locality时为本地优先后的节点), 按CacheUniqueId升序排列, 调用期间持有repo的读锁, 不能修改也不能保留
+// hint为选择的提示(例如一致性hash的key), 不需要时忽略; 没有可选节点时返回nil
+type Picker interface {
+	Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo
+}
+
+// 可以直接排除部分节点的Picker, 重试时传入完整的节点列表, 例如一致性hash不需要重建hash环
+type excludePicker interface {
+	pickExcept(nodes []*SrvNodeInfo, hint string, exclude map[string]bool) *SrvNodeInfo
+}
+
+type pickHintKey struct{}
+
+// WithPickHint 设置ServiceTransport和ServiceDialer选择节点时传给Picker的hint, 例如consistenthash的key
+func WithPickHint(ctx context.Context, hint string) context.Context {
+	return context.WithValue(ctx, pickHintKey{}, hint)
+}
+
+// PickHint 返回WithPickHint设置的hint, 没有设置时为空
+func PickHint(ctx context.Context) string {
+	hint, _ := ctx.Value(pickHintKey{}).(string)
+	return hint
+}
+
+// RoundRobinPicker 按CacheUniqueId顺序轮询
+// 记录上一次选中的节点id而不是下标, 节点增删时轮询顺序不会跳动
+type RoundRobinPicker struct {
+	locker sync.Mutex
+	last   string
+}
+
+func NewRoundRobinPicker() *RoundRobinPicker {
+	return new(RoundRobinPicker)
+}
+
+func (this *RoundRobinPicker) Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	idx := sort.Search(len(nodes), func(i int) bool {
+		return nodes[i].CacheUniqueId > this.last
+	})
+	if idx >= len(nodes) {
+		idx = 0
+	}
+	this.last = nodes[idx].CacheUniqueId
+	return nodes[idx]
+}
+
+// 重建可选节点列表, 缓存节点变化或者剔除状态变化后调用, 调用方需要持有locker写锁
+func (this *SubSrvNodeList) refreshPickNodes(now time.Time) {
+	nodes := make([]*SrvNodeInfo, 0, len(this.NodeInfos))
+	for _, info := range this.NodeInfos {
+		if isNodeAvailable(info, now) {
+			nodes = append(nodes, info)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].CacheUniqueId < nodes[j].CacheUniqueId
+	})
+	this.pickNodes = FilterLocality(this.locality, nodes, func(info *SrvNodeInfo) (string, string) {
+		return info.RegInfo.Global.Zone, info.RegInfo.Global.Region
+	})
+}
+
+// FilterLocality 依次尝试本地Zone和本地Region, 节点数足够时只返回本地节点, 否则返回全部节点
+// location返回节点的Zone和Region, 供srvdiscovergrpc等按同样的规则回退
+func FilterLocality[T any](locality SubscribeLocality, nodes []T, location func(T) (zone string, region string)) []T {
+	minNodes := max(locality.MinNodes, 1)
+	if len(locality.Zone) > 0 {
+		local := filterNodes(nodes, func(node T) bool {
+			zone, _ := location(node)
+			return zone == locality.Zone
+		})
+		if len(local) >= minNodes {
+			return local
+		}
+	}
+	if len(locality.Region) > 0 {
+		local := filterNodes(nodes, func(node T) bool {
+			_, region := location(node)
+			return region == locality.Region
+		})
+		if len(local) >= minNodes {
+			return local
+		}
+	}
+	return nodes
+}
+
+func isNodeOnline(info *SrvNodeInfo) bool {
+	return stringUtil.CompareIgnoreCase(info.RegInfo.Global.State, STATE_ONLINE)
+}
+
+func filterNodes[T any](nodes []T, filterFunc func(T) bool) []T {
+	arr := make([]T, 0, len(nodes))
+	for _, info := range nodes {
+		if filterFunc(info) {
+			arr = append(arr, info)
+		}
+	}
+	return arr
+}
+
+// SetPicker 设置订阅服务的选择策略, 默认为RoundRobinPicker
+func (this *Repo) SetPicker(name string, picker Picker) error {
+	if picker == nil {
+		return fmt.Errorf("picker is nil")
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	srvNodeList := this.getSubsNodeList(name)
+	if srvNodeList == nil {
+		return fmt.Errorf("service %s is not subscribed", name)
+	}
+	srvNodeList.picker = picker
+	return nil
+}
+
+// Next 按服务的Picker选择一个online节点, 只复制选中的节点
+func (this *Repo) Next(name string) (RegisterInfo, bool) {
+	return this.pick(name, "")
+}
+
+func (this *Repo) pick(name string, hint string) (RegisterInfo, bool) {
+	return this.pickExcept(name, hint, nil)
+}
+
+// 排除exclude(CacheUniqueId)中的节点后调用一次Picker, 用于失败后换节点重试
+// exclude为空或者Picker实现了excludePicker时传入完整的pickNodes, 不会改变Picker看到的节点集合
+func (this *Repo) pickExcept(name string, hint string, exclude map[string]bool) (RegisterInfo, bool) {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	srvNodeList := this.getSubsNodeList(name)
+	if srvNodeList == nil || srvNodeList.picker == nil {
+		return RegisterInfo{}, false
+	}
+	nodes := srvNodeList.pickNodes
+	var info *SrvNodeInfo
+	if picker, ok := srvNodeList.picker.(excludePicker); ok {
+		info = picker.pickExcept(nodes, hint, exclude)
+	} else {
+		if len(exclude) > 0 {
+			nodes = filterNodes(nodes, func(info *SrvNodeInfo) bool {
+				return !exclude[info.CacheUniqueId]
+			})
+		}
+		info = srvNodeList.picker.Pick(nodes, hint)
+	}
+	if info == nil {
+		return RegisterInfo{}, false
+	}
+	return info.RegInfo.DeepClone(false), true
+}
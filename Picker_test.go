@@ -0,0 +1,254 @@
+package srvDiscover
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func newTestNodeList(nodeIds ...string) *SubSrvNodeList {
+	nodeList := newSubSrvNodeList(SubBasicInfo{Name: "svc", Namespace: DEFAULT_NAMESPACE})
+	for idx, nodeId := range nodeIds {
+		upsertNodeList(newTestKv("svc", nodeId, "v1", int64(idx+1)), nodeList)
+	}
+	nodeList.refreshPickNodes(time.Now())
+	return nodeList
+}
+
+func Test_RoundRobinPickerStable(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2", "n3")
+	picker := NewRoundRobinPicker()
+
+	//pickNodes按CacheUniqueId排序, 轮询顺序与之一致
+	order := make([]string, 0, len(nodeList.pickNodes))
+	for _, info := range nodeList.pickNodes {
+		order = append(order, info.RegInfo.Global.NodeId)
+	}
+	for i := 0; i < 4; i++ {
+		nodeId := picker.Pick(nodeList.pickNodes, "").RegInfo.Global.NodeId
+		if nodeId != order[i%len(order)] {
+			t.Fatalf("pick %d expect %s, got %s", i, order[i%len(order)], nodeId)
+		}
+	}
+
+	//删除下一个节点后从它的后继继续, 不会重复选中刚选过的节点
+	kv := newTestKv("svc", order[1], "", 10)
+	nodeList.NodeInfos, _ = removeNode(nodeList.NodeInfos, string(kv.Key), kv.ModRevision)
+	nodeList.refreshPickNodes(time.Now())
+	if nodeId := picker.Pick(nodeList.pickNodes, "").RegInfo.Global.NodeId; nodeId != order[2] {
+		t.Fatalf("expect %s after removing %s, got %s", order[2], order[1], nodeId)
+	}
+
+	if picker.Pick(nil, "") != nil {
+		t.Fatal("expect nil for empty nodes")
+	}
+}
+
+func Test_RepoNextRoundRobin(t *testing.T) {
+	repo := new(Repo)
+	repo.initSubsNodeCache([]SubBasicInfo{*NewSubSrvBasicInfo("svc", "", DEFAULT_NAMESPACE)})
+	nodeList := repo.subsNodeCache["svc"]
+	for idx, nodeId := range []string{"n1", "n2", "n3"} {
+		upsertNodeList(newTestKv("svc", nodeId, "v1", int64(idx+1)), nodeList)
+	}
+	nodeList.refreshPickNodes(time.Now())
+
+	counts := make(map[string]int)
+	last := ""
+	for i := 0; i < 6; i++ {
+		info, ok := repo.Next("SVC")
+		if !ok {
+			t.Fatal("expect node")
+		}
+		if info.Global.NodeId == last {
+			t.Fatalf("pick %d repeats %s", i, last)
+		}
+		last = info.Global.NodeId
+		counts[last]++
+	}
+	if len(counts) != 3 || counts["n1"] != 2 || counts["n2"] != 2 || counts["n3"] != 2 {
+		t.Fatalf("unexpected distribution: %v", counts)
+	}
+
+	if _, ok := repo.Next("other"); ok {
+		t.Fatal("expect false for unsubscribed service")
+	}
+}
+
+func Test_refreshPickNodesOnlineOnly(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2")
+	nodeList.NodeInfos[0].RegInfo.Global.State = STATE_OFFLINE
+	nodeList.refreshPickNodes(time.Now())
+	if len(nodeList.pickNodes) != 1 || nodeList.pickNodes[0].RegInfo.Global.NodeId != "n2" {
+		t.Fatalf("unexpected pick nodes: %d", len(nodeList.pickNodes))
+	}
+}
+
+func Test_WeightedPicker(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2")
+	for _, info := range nodeList.NodeInfos {
+		if info.RegInfo.Global.NodeId == "n1" {
+			info.RegInfo.Profile = RegisterProfileInfo{Cpu: 90, Memory: 90}
+		} else {
+			info.RegInfo.Profile = RegisterProfileInfo{Cpu: 10, Memory: 10}
+		}
+	}
+
+	weight := DefaultProfileWeights.Weight(RegisterProfileInfo{Cpu: 90, Memory: 90})
+	if weight != 10 {
+		t.Fatalf("unexpected weight %v", weight)
+	}
+	if weight = DefaultProfileWeights.Weight(RegisterProfileInfo{Cpu: 200, Memory: 100}); weight != MIN_PICK_WEIGHT {
+		t.Fatalf("unexpected weight %v for overloaded node", weight)
+	}
+
+	picker := NewWeightedPicker(DefaultProfileWeights)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		counts[picker.Pick(nodeList.pickNodes, "").RegInfo.Global.NodeId]++
+	}
+	if counts["n2"] < counts["n1"]*4 {
+		t.Fatalf("lightly loaded node not preferred: %v", counts)
+	}
+
+	//权重为0的节点不会被选中
+	picker = NewWeightedPickerFunc(func(profile RegisterProfileInfo) float64 {
+		return float64(100 - profile.Cpu - 10)
+	})
+	for i := 0; i < 100; i++ {
+		if nodeId := picker.Pick(nodeList.pickNodes, "").RegInfo.Global.NodeId; nodeId != "n2" {
+			t.Fatalf("zero weight node picked: %s", nodeId)
+		}
+	}
+}
+
+func Test_ConsistentHashPickerMinimalMove(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2", "n3")
+	picker := NewConsistentHashPicker(0)
+
+	const keyCount = 3000
+	before := make([]string, keyCount)
+	counts := make(map[string]int)
+	for i := 0; i < keyCount; i++ {
+		before[i] = picker.Pick(nodeList.pickNodes, fmt.Sprintf("call-%d", i)).RegInfo.Global.NodeId
+		counts[before[i]]++
+	}
+	for nodeId, count := range counts {
+		if count < keyCount/6 {
+			t.Fatalf("uneven distribution for %s: %v", nodeId, counts)
+		}
+	}
+
+	//增加节点后只有迁移到新节点的key发生变化
+	upsertNodeList(newTestKv("svc", "n4", "v1", 10), nodeList)
+	nodeList.refreshPickNodes(time.Now())
+	moved := 0
+	for i := 0; i < keyCount; i++ {
+		nodeId := picker.Pick(nodeList.pickNodes, fmt.Sprintf("call-%d", i)).RegInfo.Global.NodeId
+		if nodeId == before[i] {
+			continue
+		}
+		if nodeId != "n4" {
+			t.Fatalf("key moved from %s to %s", before[i], nodeId)
+		}
+		moved++
+	}
+	if moved == 0 || moved > keyCount/2 {
+		t.Fatalf("unexpected moved keys %d", moved)
+	}
+}
+
+func Test_ConsistentHashPickerExcept(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2", "n3")
+	picker := NewConsistentHashPicker(0)
+
+	first := picker.Pick(nodeList.pickNodes, "call-1")
+	ring := picker.ring
+	exclude := map[string]bool{first.CacheUniqueId: true}
+	second := picker.pickExcept(nodeList.pickNodes, "call-1", exclude)
+	if second == nil || second == first {
+		t.Fatalf("excluded node picked again: %v", second)
+	}
+	if again := picker.pickExcept(nodeList.pickNodes, "call-1", exclude); again != second {
+		t.Fatal("retry node is not stable")
+	}
+	//重试沿用已有的hash环
+	if &picker.ring[0] != &ring[0] {
+		t.Fatal("hash ring rebuilt on retry")
+	}
+
+	exclude[second.CacheUniqueId] = true
+	third := picker.pickExcept(nodeList.pickNodes, "call-1", exclude)
+	if third == nil || third == first || third == second {
+		t.Fatalf("unexpected third node: %v", third)
+	}
+	exclude[third.CacheUniqueId] = true
+	if info := picker.pickExcept(nodeList.pickNodes, "call-1", exclude); info != nil {
+		t.Fatalf("all nodes excluded but picked %s", info.CacheUniqueId)
+	}
+}
+
+func Test_SubscribeLocalityFilter(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2", "n3")
+	zones := map[string][2]string{
+		"n1": {"z1", "r1"},
+		"n2": {"z2", "r1"},
+		"n3": {"z3", "r2"},
+	}
+	for _, info := range nodeList.NodeInfos {
+		zone := zones[info.RegInfo.Global.NodeId]
+		info.RegInfo.Global.Zone = zone[0]
+		info.RegInfo.Global.Region = zone[1]
+	}
+
+	nodeList.locality = SubscribeLocality{Zone: "z1", Region: "r1"}
+	nodeList.refreshPickNodes(time.Now())
+	if len(nodeList.pickNodes) != 1 || nodeList.pickNodes[0].RegInfo.Global.NodeId != "n1" {
+		t.Fatalf("expect local zone only, got %d nodes", len(nodeList.pickNodes))
+	}
+
+	//本地Zone不足时回退到本地Region
+	nodeList.locality.MinNodes = 2
+	nodeList.refreshPickNodes(time.Now())
+	if len(nodeList.pickNodes) != 2 {
+		t.Fatalf("expect local region fallback, got %d nodes", len(nodeList.pickNodes))
+	}
+
+	nodeList.locality = SubscribeLocality{Zone: "z4", Region: "r3"}
+	nodeList.refreshPickNodes(time.Now())
+	if len(nodeList.pickNodes) != 3 {
+		t.Fatalf("expect all nodes fallback, got %d nodes", len(nodeList.pickNodes))
+	}
+}
+
+func Test_P2CPicker(t *testing.T) {
+	nodeList := newTestNodeList("n1", "n2")
+	repo := new(Repo)
+	repo.subsNodeCache = map[string]*SubSrvNodeList{"svc": nodeList}
+
+	var busy RegisterInfo
+	for _, info := range nodeList.NodeInfos {
+		if info.RegInfo.Global.NodeId == "n1" {
+			busy = info.RegInfo
+		}
+	}
+	for i := 0; i < 3; i++ {
+		repo.Acquire(busy)
+	}
+
+	picker := NewP2CPicker()
+	for i := 0; i < 100; i++ {
+		if nodeId := picker.Pick(nodeList.pickNodes, "").RegInfo.Global.NodeId; nodeId != "n2" {
+			t.Fatalf("busy node picked: %s", nodeId)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		repo.Release(busy)
+	}
+	for _, info := range nodeList.NodeInfos {
+		if info.InFlight() != 0 {
+			t.Fatalf("unexpected inflight %d for %s", info.InFlight(), info.RegInfo.Global.NodeId)
+		}
+	}
+}
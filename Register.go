@@ -11,32 +11,50 @@ import (
 	"context"
 	"fmt"
 	clientv3 "go.etcd.io/etcd/client/v3"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
-var stateLocker = new(sync.RWMutex)
-var currentNodeState = STATE_NOTREADY
-var updateRegisterAction int32 = 0
+// 节点状态和更新版本, 零值即为notReady
+// 多个注册项可以共用一个状态, 每个注册项记录自己put过的版本, 版本变化时都会重新put
+type nodeState struct {
+	locker  sync.RWMutex
+	state   string
+	version atomic.Int64
+}
+
+func (this *nodeState) get() string {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	if len(this.state) == 0 {
+		return STATE_NOTREADY
+	}
+	return this.state
+}
+
+func (this *nodeState) set(state string) {
+	this.locker.Lock()
+	this.state = state
+	this.version.Add(1)
+	this.locker.Unlock()
+}
+
+func (this *nodeState) markUpdate() {
+	this.version.Add(1)
+}
 
 func (this *Repo) UpdateOnce() {
-	atomic.StoreInt32(&updateRegisterAction, 1)
+	this.state.markUpdate()
 }
 func (this *Repo) GetState() string {
-	var res string
-	stateLocker.RLock()
-	res = currentNodeState
-	stateLocker.RUnlock()
-	return res
+	return this.state.get()
 }
 
 func (this *Repo) ChangeState(state string) {
-	stateLocker.Lock()
-	currentNodeState = state
-	atomic.StoreInt32(&updateRegisterAction, 1)
-	stateLocker.Unlock()
+	this.state.set(state)
 }
 
 // Register
@@ -48,178 +66,279 @@ func (this *Repo) ChangeState(state string) {
 // KeepAliveOnce: 为 lease 续约一次，代码注释中说大部分情况下都应该使用 KeepAlive；
 // Close: 关闭当前客户端建立的所有 lease；
 func (this *Repo) Register(srvInfo *RegisterInfo, options ...RegisterOptionFunc) {
-	regOption := new(RegisterOption)
-	*regOption = defaultRegisterOption
+	this.RegisterContext(context.Background(), srvInfo, options...)
+}
 
-	for _, op := range options {
-		op(regOption)
+// RegisterContext 阻塞注册直到ctx结束或者repo被Close, 退出前删除注册的key
+// 使用Repo的节点状态, 即ChangeState/UpdateOnce作用于此注册
+func (this *Repo) RegisterContext(ctx context.Context, srvInfo *RegisterInfo, options ...RegisterOptionFunc) {
+	if !this.beginRoutine() {
+		return
 	}
+	defer this.routineWg.Done()
 
-	var lease *clientv3.LeaseGrantResponse = nil
+	ctx, cancel, err := this.bindContext(ctx)
+	if err != nil {
+		return
+	}
+	defer cancel()
+
+	reg, err := this.addRegistration(srvInfo, &this.state, options...)
+	if err != nil {
+		this.log().Error("add registration failed", LOG_KEY_ERROR, err)
+		return
+	}
+
+	<-ctx.Done()
+	removeCtx, cancel2 := context.WithTimeout(context.Background(), reg.option.ConnTimeout)
+	_ = reg.Remove(removeCtx)
+	cancel2()
+}
+
+// 一个lease分组的注册循环, 所有成员移除或者ctx结束后退出
+func (this *Repo) runLeaseGroup(ctx context.Context, group *leaseGroup) {
+	defer this.routineWg.Done()
+	defer group.cancel()
+
+	regOption := group.option
+	var lease LeaseID
 	var err error
 
 	for {
+		if ctx.Err() != nil {
+			return
+		}
 		if !this.registerEnable.Load() {
-			time.Sleep(time.Second)
+			sleepContext(ctx, time.Second)
 			continue
 		}
 
-		this.registerBlockCheckServerLive(regOption)
-		ctx, cancel := context.WithTimeout(context.TODO(), regOption.ConnTimeout)
-		lease, err = this.client.Grant(ctx, regOption.TTLSec)
-		cancel()
-		if err != nil || lease == nil {
-			if err != nil {
-				log.Printf("client Grant error:%s\n", err.Error())
+		if !this.registerBlockCheckServerLive(ctx, group) {
+			return
+		}
+		lease, err = this.grantLease(ctx, group)
+		if ctx.Err() != nil {
+			if err == nil {
+				this.revokeLease(lease, regOption.ConnTimeout)
 			}
-			regOption.ResultCallback(fmt.Errorf("client Grant error:%w", err))
-			time.Sleep(time.Second * 3)
+			return
+		}
+		countResult(err, &this.stats.grantSuccess, &this.stats.grantError)
+		if err != nil {
+			this.log().Warn("lease grant failed", LOG_KEY_LEASE_GROUP, group.name, LOG_KEY_ERROR, err)
+			group.notify(fmt.Errorf("client Grant error:%w", err))
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 
-		this.fillRegModuleInfo(srvInfo, regOption.BeforeRegister)
-		err := this.clientUpdateLeaseContent(lease, srvInfo, regOption)
+		err := this.putGroupMembers(ctx, lease, group, true)
 		if err != nil {
-			log.Printf("clientUpdateLeaseContent error:%s\n", err.Error())
-			regOption.ResultCallback(fmt.Errorf("clientUpdateLeaseContent error:%w", err))
-			connCtx, cancel2 := context.WithTimeout(context.TODO(), regOption.ConnTimeout)
-			_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
-			cancel2()
-			time.Sleep(time.Second * 3)
+			this.revokeLease(lease, regOption.ConnTimeout)
+			if ctx.Err() != nil {
+				return
+			}
+			sleepContext(ctx, time.Second*3)
 			continue
 		}
 
 		//block here until recv error
-		this.KeepaliveLease(lease, srvInfo, regOption)
+		this.keepaliveGroup(ctx, lease, group)
 	}
 }
-func (this *Repo) registerBlockCheckServerLive(regOption *RegisterOption) {
+
+// 申请分组使用的lease
+func (this *Repo) grantLease(ctx context.Context, group *leaseGroup) (LeaseID, error) {
+	regOption := group.option
+	ctx, span := this.startSpan(ctx, "srvDiscover.Grant", ATTR_SERVICE.String(group.serviceNames()), ATTR_LEASE_GROUP.String(group.name),
+		ATTR_NAMESPACE.String(regOption.Namespace), attribute.Int64("srvdiscover.ttl", regOption.TTLSec))
+	grantCtx, cancel := context.WithTimeout(ctx, regOption.ConnTimeout)
+	lease, err := this.backend.Grant(grantCtx, regOption.TTLSec)
+	cancel()
+	endSpan(span, err)
+	return lease, err
+}
+
+// 阻塞直到etcd可用, ctx结束时返回false
+func (this *Repo) registerBlockCheckServerLive(ctx context.Context, group *leaseGroup) bool {
 	for {
+		if ctx.Err() != nil {
+			return false
+		}
 		if !this.registerEnable.Load() {
-			return
+			return true
 		}
-		ctx, cancel := context.WithTimeout(context.TODO(), time.Second*3)
-		mlist, err := this.client.MemberList(ctx)
+		checkCtx, cancel := context.WithTimeout(ctx, time.Second*3)
+		err := this.backend.Ping(checkCtx)
 		cancel()
-		_ = mlist
 		if err != nil {
-			log.Printf("client MemberList error:%s\n", err.Error())
-			regOption.ResultCallback(fmt.Errorf("client MemberList error:%w", err))
-			time.Sleep(time.Second)
+			if ctx.Err() != nil {
+				return false
+			}
+			this.log().Warn("etcd not available", LOG_KEY_LEASE_GROUP, group.name, LOG_KEY_ERROR, err)
+			group.notify(fmt.Errorf("client MemberList error:%w", err))
+			sleepContext(ctx, time.Second)
 			continue
 		}
-		break
+		return true
 	}
 }
 
+// put分组内的成员, all为false时只put需要更新的成员, 任意一个失败则返回错误
+func (this *Repo) putGroupMembers(ctx context.Context, lease LeaseID, group *leaseGroup, all bool) error {
+	for _, reg := range group.snapshot() {
+		update := reg.needUpdate()
+		if !all && !update {
+			continue
+		}
+		err := reg.put(ctx, lease)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			reg.report(fmt.Errorf("clientUpdateLeaseContent error:%w", err))
+			return err
+		}
+		reg.report(nil)
+	}
+	return nil
+}
+
 func (this *Repo) KeepaliveLease(lease *clientv3.LeaseGrantResponse, srvInfo *RegisterInfo, regOption *RegisterOption) {
+	reg := &Registration{
+		repo:    this,
+		option:  regOption,
+		state:   &this.state,
+		info:    srvInfo,
+		version: this.state.version.Load(),
+	}
+	reg.status.global = srvInfo.Global
+	group := &leaseGroup{
+		option:  regOption,
+		members: []*Registration{reg},
+	}
+	this.keepaliveGroup(this.ctx, LeaseID(lease.ID), group)
+}
+
+// ctx结束时撤销租约后返回, 使注册的key立即消失
+func (this *Repo) keepaliveGroup(ctx context.Context, lease LeaseID, group *leaseGroup) {
+	regOption := group.option
+
 	// 创建上下文和取消函数用于租约续约
-	ctx, cancel0 := context.WithCancel(context.Background())
+	keepaliveCtx, cancel0 := context.WithCancel(ctx)
 	defer cancel0()
 
-	keepaliveChan, err := this.client.KeepAlive(ctx, lease.ID) //这里需要一直不断，context不允许设置超时
+	keepaliveChan, err := this.backend.KeepAlive(keepaliveCtx, lease) //这里需要一直不断，context不允许设置超时
 	if err != nil || keepaliveChan == nil {
+		this.stats.keepaliveError.Add(1)
+		this.revokeLease(lease, regOption.ConnTimeout)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
-			log.Printf("client KeepAlive error:%s\n", err.Error())
+			this.log().Warn("lease keepalive failed", LOG_KEY_LEASE_GROUP, group.name, LOG_KEY_ERROR, err)
+		} else {
+			this.log().Warn("lease keepalive channel is nil", LOG_KEY_LEASE_GROUP, group.name)
+			err = fmt.Errorf("keepalive channel is nil")
 		}
-		regOption.ResultCallback(fmt.Errorf("client KeepAlive error:%w", err))
-		connCtx, cancel2 := context.WithTimeout(context.TODO(), regOption.ConnTimeout)
-		_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
-		cancel2()
-		time.Sleep(time.Millisecond * 100)
+		this.traceKeepaliveLost(ctx, group, err)
+		group.notify(fmt.Errorf("client KeepAlive error:%w", err))
+		sleepContext(ctx, time.Millisecond*100)
 		return
 	}
 
-	//if regOption.BeforeRegister == nil {
-	//	for range keepaliveChan {
-	//	}
-	//	log.Printf("keepaliveChan error\n")
-	//	this.client.Lease.Revoke(context.TODO(), lease.ID)
-	//	return
-	//}
-
-	timeSaved := time.Now()
 	for {
 		select {
-		case keepaliveResponse := <-keepaliveChan:
+		case <-ctx.Done():
+			this.revokeLease(lease, regOption.ConnTimeout)
+			return
+		case _, ok := <-keepaliveChan:
+			if ctx.Err() != nil {
+				this.revokeLease(lease, regOption.ConnTimeout)
+				return
+			}
 			if !this.registerEnable.Load() {
-				connCtx, cancel2 := context.WithTimeout(context.TODO(), regOption.ConnTimeout)
-				_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
-				cancel2()
+				this.revokeLease(lease, regOption.ConnTimeout)
 				return
 			}
-			//if recv nil, lease is expired
-			if keepaliveResponse == nil {
-				regOption.ResultCallback(fmt.Errorf("keepalive channle recv nil,lease is expired"))
-				//connCtx, _ := context.WithTimeout(context.TODO(), time.Second*2)
-				//_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
+			//channel closed, lease is expired
+			if !ok {
+				this.stats.keepaliveError.Add(1)
+				this.log().Warn("lease keepalive lost", LOG_KEY_LEASE_GROUP, group.name)
+				this.traceKeepaliveLost(ctx, group, fmt.Errorf("lease is expired"))
+				group.notify(fmt.Errorf("keepalive channle recv nil,lease is expired"))
 				return
 			}
 			//renewal success, continue
-			regOption.ResultCallback(nil)
+			this.stats.keepaliveSuccess.Add(1)
+			group.notify(nil)
 			continue
 		default:
 			if !this.registerEnable.Load() {
-				connCtx, cancel2 := context.WithTimeout(context.TODO(), regOption.ConnTimeout)
-				_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
-				cancel2()
+				this.revokeLease(lease, regOption.ConnTimeout)
 				return
 			}
-			//强制更新操作，则不进入常规判断，直接更新
-			if atomic.LoadInt32(&updateRegisterAction) > 0 {
-				atomic.StoreInt32(&updateRegisterAction, 0)
-			} else {
-				if !regOption.AlwaysUpdate {
-					//regOption.ResultCallback(nil)
-					time.Sleep(1000 * time.Millisecond)
-					continue
-				}
-
-				if time.Since(timeSaved) < regOption.Interval {
-					//regOption.ResultCallback(nil)
-					time.Sleep(200 * time.Millisecond)
-					continue
-				}
-			}
 
-			this.fillRegModuleInfo(srvInfo, regOption.BeforeRegister)
-			err := this.clientUpdateLeaseContent(lease, srvInfo, regOption)
+			//成员有强制更新标记或者AlwaysUpdate到达间隔时更新
+			err := this.putGroupMembers(ctx, lease, group, false)
 			if err != nil {
-				log.Printf("clientUpdateLeaseContent error:%s\n", err.Error())
-				regOption.ResultCallback(fmt.Errorf("clientUpdateLeaseContent error:%w", err))
-				connCtx, cancel2 := context.WithTimeout(context.TODO(), time.Second*2)
-				_, _ = this.client.Lease.Revoke(connCtx, lease.ID)
-				cancel2()
-				//this.client.Lease.Close()
+				this.revokeLease(lease, time.Second*2)
 				return
 			}
 
-			regOption.ResultCallback(nil)
-			timeSaved = time.Now()
+			if group.alwaysUpdate() {
+				sleepContext(ctx, 200*time.Millisecond)
+			} else {
+				sleepContext(ctx, 1000*time.Millisecond)
+			}
 		}
 	}
 }
 
-func (this *Repo) clientUpdateLeaseContent(lease *clientv3.LeaseGrantResponse, srvInfo *RegisterInfo, regOption *RegisterOption) error {
+// 记录续约中断, 便于在trace中定位注册闪断
+func (this *Repo) traceKeepaliveLost(ctx context.Context, group *leaseGroup, err error) {
+	_, span := this.startSpan(ctx, "srvDiscover.KeepAliveLost", ATTR_SERVICE.String(group.serviceNames()),
+		ATTR_LEASE_GROUP.String(group.name), ATTR_NAMESPACE.String(group.option.Namespace))
+	endSpan(span, err)
+}
+
+// 撤销租约, 调用时注册的ctx可能已经结束, 因此单独使用超时ctx
+func (this *Repo) revokeLease(lease LeaseID, timeout time.Duration) {
+	connCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	_ = this.backend.Revoke(connCtx, lease)
+	cancel()
+}
+
+// 返回put的key
+func (this *Repo) clientUpdateLeaseContent(ctx context.Context, lease LeaseID, srvInfo *RegisterInfo, regOption *RegisterOption) (string, error) {
 	key := srvInfo.FormatRegisterKey(regOption.Namespace)
 	value := srvInfo.Serialize()
 	valueStr := string(value)
 
 	//fmt.Println("keep", key, valueStr)
-	_, err := this.client.Put(context.TODO(), key, valueStr, clientv3.WithLease(lease.ID))
-	if err != nil {
-		log.Printf("client put error:%s\n", err.Error())
+	ctx, span := this.startSpan(ctx, "srvDiscover.Put", ATTR_SERVICE.String(srvInfo.Global.Name),
+		ATTR_NAMESPACE.String(regOption.Namespace), ATTR_NODE_ID.String(srvInfo.Global.NodeId), ATTR_KEY.String(key))
+	putCtx, cancel := context.WithTimeout(ctx, regOption.ConnTimeout)
+	revision, err := this.backend.Put(putCtx, key, valueStr, lease)
+	cancel()
+	if err == nil {
+		span.SetAttributes(ATTR_REVISION.Int64(revision))
+	}
+	endSpan(span, err)
+	if ctx.Err() == nil {
+		countResult(err, &this.stats.putSuccess, &this.stats.putError)
+	}
+	if err != nil && ctx.Err() == nil {
+		this.log().Warn("registration put failed", LOG_KEY_SERVICE, srvInfo.Global.Name, LOG_KEY_NODE_ID, srvInfo.Global.NodeId,
+			LOG_KEY_KEY, key, LOG_KEY_ERROR, err)
 	}
-	return err
+	return key, err
 }
 
-func (this *Repo) fillRegModuleInfo(info *RegisterInfo, beforeRegisterFunc BeforeRegisterFunc) {
+func (this *Repo) fillRegModuleInfo(info *RegisterInfo, state *nodeState, beforeRegisterFunc BeforeRegisterFunc) {
 	if beforeRegisterFunc != nil {
 		beforeRegisterFunc(info)
 	}
 
-	stateLocker.RLock()
-	info.Global.State = currentNodeState
-	stateLocker.RUnlock()
+	info.Global.State = state.get()
 	info.Global.RefreshTimestamp(time.Now())
 }
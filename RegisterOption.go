@@ -10,6 +10,7 @@ type RegisterOption struct {
 	AlwaysUpdate   bool
 	Interval       time.Duration
 	ConnTimeout    time.Duration
+	LeaseGroup     string //相同分组的注册共用一个lease, 为空则独占
 }
 
 // 注册提供的默认值
@@ -78,3 +79,9 @@ func WithRegisterAlwaysUpdate(isLoop bool) RegisterOptionFunc {
 		option.AlwaysUpdate = isLoop
 	}
 }
+
+func WithRegisterLeaseGroup(group string) RegisterOptionFunc {
+	return func(option *RegisterOption) {
+		option.LeaseGroup = group
+	}
+}
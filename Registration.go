@@ -0,0 +1,303 @@
+package srvDiscover
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Registration 一个注册项, 拥有独立的key、状态、BeforeRegisterFunc和结果回调
+// 同一个leaseGroup里的注册项共用一个lease
+type Registration struct {
+	repo   *Repo
+	group  *leaseGroup
+	option *RegisterOption
+	state  *nodeState
+
+	locker  sync.Mutex //保护info、removed和version, put期间的网络请求不持有
+	info    *RegisterInfo
+	removed bool
+	version int64 //最后一次检查时的状态版本, 初始为-1使新成员立即put
+
+	statusLocker sync.Mutex //只在读写status时持有, Key和DebugInfo不会等待BeforeRegister或者put
+	status       registrationStatus
+}
+
+// 注册结果, 供Key、DebugInfo和指标采集读取
+type registrationStatus struct {
+	global    RegisterGlobalInfo //最后一次填充的注册信息
+	key       string             //最后一次put成功的key
+	timeSaved time.Time
+	lastErr   error //最后一次注册结果
+}
+
+// 共用一个lease的注册集合, 由一个协程负责Grant/KeepAlive并put所有成员
+type leaseGroup struct {
+	name    string
+	option  *RegisterOption //TTL和ConnTimeout取第一个成员的配置
+	cancel  context.CancelFunc
+	locker  sync.RWMutex
+	members []*Registration
+}
+
+func (this *leaseGroup) snapshot() []*Registration {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	arr := make([]*Registration, len(this.members))
+	copy(arr, this.members)
+	return arr
+}
+
+// 组级别的错误(Grant/KeepAlive等)通知所有成员
+func (this *leaseGroup) notify(err error) {
+	for _, reg := range this.snapshot() {
+		reg.report(err)
+	}
+}
+
+// 成员的服务名, 多个服务时按加入顺序用逗号连接, 用于span的属性
+func (this *leaseGroup) serviceNames() string {
+	var names []string
+	for _, reg := range this.snapshot() {
+		name := reg.serviceName()
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+func (this *leaseGroup) alwaysUpdate() bool {
+	for _, reg := range this.snapshot() {
+		if reg.option.AlwaysUpdate {
+			return true
+		}
+	}
+	return false
+}
+
+// AddRegistration 增加一个注册项并立即开始注册, 返回的句柄可以单独修改状态或者移除
+// 通过WithRegisterLeaseGroup指定相同分组的注册项共用一个lease
+func (this *Repo) AddRegistration(srvInfo *RegisterInfo, options ...RegisterOptionFunc) (*Registration, error) {
+	return this.addRegistration(srvInfo, new(nodeState), options...)
+}
+
+// Registrations 返回当前所有注册项
+func (this *Repo) Registrations() []*Registration {
+	this.regLocker.Lock()
+	defer this.regLocker.Unlock()
+
+	arr := make([]*Registration, 0, len(this.registrations))
+	arr = append(arr, this.registrations...)
+	return arr
+}
+
+func (this *Repo) addRegistration(srvInfo *RegisterInfo, state *nodeState, options ...RegisterOptionFunc) (*Registration, error) {
+	if srvInfo == nil {
+		return nil, fmt.Errorf("register info is nil")
+	}
+
+	regOption := new(RegisterOption)
+	*regOption = defaultRegisterOption
+	for _, op := range options {
+		op(regOption)
+	}
+	if regOption.ResultCallback == nil {
+		regOption.ResultCallback = func(err error) {}
+	}
+
+	reg := &Registration{
+		repo:    this,
+		option:  regOption,
+		state:   state,
+		info:    srvInfo,
+		version: -1,
+	}
+	reg.status.global = srvInfo.Global
+
+	this.regLocker.Lock()
+	defer this.regLocker.Unlock()
+
+	groupName := regOption.LeaseGroup
+	if len(groupName) == 0 {
+		this.regSeq++
+		groupName = fmt.Sprintf("#%d", this.regSeq)
+	}
+
+	group, ok := this.leaseGroups[groupName]
+	if !ok {
+		if !this.beginRoutine() {
+			return nil, fmt.Errorf("repo is closed")
+		}
+		ctx, cancel, err := this.bindContext(context.Background())
+		if err != nil {
+			this.routineWg.Done()
+			return nil, err
+		}
+		group = &leaseGroup{
+			name:   groupName,
+			option: regOption,
+		}
+		group.cancel = cancel
+		if this.leaseGroups == nil {
+			this.leaseGroups = make(map[string]*leaseGroup)
+		}
+		this.leaseGroups[groupName] = group
+		go this.runLeaseGroup(ctx, group)
+	}
+
+	reg.group = group
+	group.locker.Lock()
+	group.members = append(group.members, reg)
+	group.locker.Unlock()
+	this.registrations = append(this.registrations, reg)
+	return reg, nil
+}
+
+// 从分组中摘除, 分组没有成员后停止并撤销lease
+func (this *Repo) detachRegistration(reg *Registration) {
+	this.regLocker.Lock()
+	defer this.regLocker.Unlock()
+
+	for idx := range this.registrations {
+		if this.registrations[idx] == reg {
+			this.registrations = append(this.registrations[:idx], this.registrations[idx+1:]...)
+			break
+		}
+	}
+
+	group := reg.group
+	group.locker.Lock()
+	for idx := range group.members {
+		if group.members[idx] == reg {
+			group.members = append(group.members[:idx], group.members[idx+1:]...)
+			break
+		}
+	}
+	empty := len(group.members) == 0
+	group.locker.Unlock()
+
+	if empty {
+		group.cancel()
+		delete(this.leaseGroups, group.name)
+	}
+}
+
+// 填充注册信息后put, 已经移除的注册项直接跳过
+// put使用注册信息的副本, 不持有locker, etcd无响应时Key、Info和Remove不会被阻塞
+func (this *Registration) put(ctx context.Context, lease LeaseID) error {
+	this.locker.Lock()
+	if this.removed {
+		this.locker.Unlock()
+		return nil
+	}
+	this.repo.fillRegModuleInfo(this.info, this.state, this.option.BeforeRegister)
+	info := this.info.DeepClone(true)
+	this.statusLocker.Lock()
+	this.status.global = info.Global
+	this.statusLocker.Unlock()
+	this.locker.Unlock()
+
+	key, err := this.repo.clientUpdateLeaseContent(ctx, lease, &info, this.option)
+	if err != nil {
+		return err
+	}
+
+	this.locker.Lock()
+	if this.removed {
+		//put期间被Remove, 删除可能重新写入的key
+		this.locker.Unlock()
+		deleteCtx, cancel := context.WithTimeout(context.Background(), this.option.ConnTimeout)
+		_ = this.repo.backend.Delete(deleteCtx, key)
+		cancel()
+		return nil
+	}
+	this.statusLocker.Lock()
+	this.status.key = key
+	this.status.timeSaved = time.Now()
+	this.statusLocker.Unlock()
+	this.locker.Unlock()
+	return nil
+}
+
+// 记录注册结果并通知ResultCallback
+func (this *Registration) report(err error) {
+	this.statusLocker.Lock()
+	this.status.lastErr = err
+	this.statusLocker.Unlock()
+
+	this.option.ResultCallback(err)
+}
+
+// 是否需要在本轮put, 状态版本有变化或者AlwaysUpdate到达间隔
+func (this *Registration) needUpdate() bool {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	version := this.state.version.Load()
+	if version != this.version {
+		this.version = version
+		return true
+	}
+	if !this.option.AlwaysUpdate {
+		return false
+	}
+	this.statusLocker.Lock()
+	defer this.statusLocker.Unlock()
+	return time.Since(this.status.timeSaved) >= this.option.Interval
+}
+
+// Key 最后一次注册成功的key, 尚未注册成功时为空
+func (this *Registration) Key() string {
+	this.statusLocker.Lock()
+	defer this.statusLocker.Unlock()
+	return this.status.key
+}
+
+func (this *Registration) serviceName() string {
+	this.statusLocker.Lock()
+	defer this.statusLocker.Unlock()
+	return this.status.global.Name
+}
+
+// Info 返回注册信息的副本
+func (this *Registration) Info() RegisterInfo {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	return this.info.DeepClone(true)
+}
+
+func (this *Registration) GetState() string {
+	return this.state.get()
+}
+
+func (this *Registration) ChangeState(state string) {
+	this.state.set(state)
+}
+
+func (this *Registration) UpdateOnce() {
+	this.state.markUpdate()
+}
+
+// Remove 停止注册并删除key, 分组内没有其它注册项时同时撤销lease
+// 不等待进行中的put, ctx结束时返回ctx的错误
+func (this *Registration) Remove(ctx context.Context) error {
+	this.locker.Lock()
+	if this.removed {
+		this.locker.Unlock()
+		return nil
+	}
+	this.removed = true
+	key := this.Key()
+	this.locker.Unlock()
+
+	this.repo.detachRegistration(this)
+	if len(key) == 0 {
+		return nil
+	}
+	return this.repo.backend.Delete(ctx, key)
+}
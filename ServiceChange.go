@@ -0,0 +1,96 @@
+package srvDiscover
+
+import (
+	"github.com/xukgo/gsaber/utils/stringUtil"
+)
+
+type nodeChangeType int
+
+const (
+	nodeUnchanged nodeChangeType = iota
+	nodeAdded
+	nodeUpdated
+	nodeRemoved
+)
+
+// ServiceChange 订阅服务的一次节点变化, 来自watch事件或者全量同步的差异
+type ServiceChange struct {
+	Service  string
+	Revision int64 //产生变化的etcd revision
+	Resync   bool  //true表示来自全量同步
+	Added    []RegisterInfo
+	Removed  []RegisterInfo
+	Updated  []RegisterInfo
+}
+
+func newServiceChange(service string, revision int64) *ServiceChange {
+	model := new(ServiceChange)
+	model.Service = service
+	model.Revision = revision
+	return model
+}
+
+func (this *ServiceChange) record(info *SrvNodeInfo, changeType nodeChangeType) {
+	switch changeType {
+	case nodeAdded:
+		this.Added = append(this.Added, info.RegInfo.DeepClone(true))
+	case nodeUpdated:
+		this.Updated = append(this.Updated, info.RegInfo.DeepClone(true))
+	case nodeRemoved:
+		this.Removed = append(this.Removed, info.RegInfo.DeepClone(true))
+	}
+}
+
+func (this *ServiceChange) Empty() bool {
+	return len(this.Added) == 0 && len(this.Removed) == 0 && len(this.Updated) == 0
+}
+
+type serviceChangeListener struct {
+	name     string
+	callback func(ServiceChange)
+}
+
+// OnServiceChange 订阅服务的节点变化, 名字不区分大小写, 返回的函数用于取消
+// 回调在该服务的watch协程里同步执行, 不应阻塞
+func (this *Repo) OnServiceChange(name string, callback func(ServiceChange)) func() {
+	listener := &serviceChangeListener{
+		name:     name,
+		callback: callback,
+	}
+
+	this.changeLocker.Lock()
+	this.changeListeners = append(this.changeListeners, listener)
+	this.changeLocker.Unlock()
+
+	return func() {
+		this.changeLocker.Lock()
+		defer this.changeLocker.Unlock()
+
+		for idx := range this.changeListeners {
+			if this.changeListeners[idx] == listener {
+				this.changeListeners = append(this.changeListeners[:idx], this.changeListeners[idx+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// 不能在持有locker时调用
+func (this *Repo) notifyServiceChange(change *ServiceChange) {
+	if change.Empty() {
+		return
+	}
+
+	this.changeLocker.RLock()
+	listeners := make([]*serviceChangeListener, 0, len(this.changeListeners))
+	for _, listener := range this.changeListeners {
+		if stringUtil.CompareIgnoreCase(listener.name, change.Service) {
+			listeners = append(listeners, listener)
+		}
+	}
+	this.changeLocker.RUnlock()
+
+	for _, listener := range listeners {
+		listener.callback(*change)
+	}
+}
@@ -0,0 +1,94 @@
+package srvDiscover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ServiceDialer 把"服务名:端口名"解析为节点的ip:port后建立连接, 可以替代net.Dialer
+// 每次连接由服务的Picker选择一个节点, 失败后才选择下一个, 直到有一个连接成功; 其它格式的地址直接交给Dialer
+// Picker的hint取自ctx的WithPickHint; 连接关闭前通过Acquire/Release记录为节点的进行中请求
+type ServiceDialer struct {
+	Repo        *Repo
+	Dialer      *net.Dialer //为nil时使用零值的net.Dialer
+	MaxAttempts int         //最多尝试的节点数, 为0时尝试所有可选节点
+	UsePublicIP bool        //使用节点的PublicIP, 默认使用PrivateIp
+}
+
+func NewServiceDialer(repo *Repo) *ServiceDialer {
+	model := new(ServiceDialer)
+	model.Repo = repo
+	return model
+}
+
+// DialContext 使用PrivateIp连接服务节点, 例如DialContext(ctx, "tcp", "SipServer:sip")
+func (this *Repo) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return NewServiceDialer(this).DialContext(ctx, network, address)
+}
+
+func (this *ServiceDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	dialer := this.Dialer
+	if dialer == nil {
+		dialer = new(net.Dialer)
+	}
+
+	service, portName, ok := splitServiceAddress(address)
+	if !ok || !this.Repo.isSubscribed(service) {
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	hint := PickHint(ctx)
+	var errs []error
+	picked := make(map[string]bool)
+	for this.MaxAttempts <= 0 || len(errs) < this.MaxAttempts {
+		info, ok := this.Repo.pickExcept(service, hint, picked)
+		if !ok {
+			break
+		}
+		picked[info.UniqueId()] = true
+		addr, ok := serviceNodeAddress(&info, portName, this.UsePublicIP)
+		if !ok {
+			continue
+		}
+		this.Repo.Acquire(info)
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err == nil {
+			this.Repo.ReportResult(service, info.Global.NodeId, nil)
+			return &releaseConn{Conn: conn, release: func() {
+				this.Repo.Release(info)
+			}}, nil
+		}
+		this.Repo.Release(info)
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		this.Repo.ReportResult(service, info.Global.NodeId, err)
+		errs = append(errs, err)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("dial service %s failed: %w", address, errors.Join(errs...))
+	}
+	return nil, fmt.Errorf("service %s has no available node with port %s", service, portName)
+}
+
+// 连接关闭时调用release, 多次Close只调用一次; 需要*net.TCPConn等底层连接时使用NetConn
+type releaseConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (this *releaseConn) Close() error {
+	err := this.Conn.Close()
+	this.once.Do(this.release)
+	return err
+}
+
+// NetConn 返回底层连接, 同tls.Conn.NetConn
+func (this *releaseConn) NetConn() net.Conn {
+	return this.Conn
+}
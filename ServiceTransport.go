@@ -0,0 +1,240 @@
+package srvDiscover
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 连接失败时最多尝试的节点数
+const DEFAULT_SERVICE_MAX_ATTEMPTS = 3
+
+// ServiceTransport 把http://PushGateway:restful/path中的服务名和端口名替换为节点的ip:port
+// 节点由服务的Picker选择, 端口取节点同名的SvcInfo; 建立连接失败时换下一个节点重试
+// Picker的hint取自WithPickHint, 没有时取HintHeader请求头; 请求期间通过Acquire/Release记录节点的进行中请求数
+// host不是订阅的服务或者端口是数字时直接交给Base处理
+//
+// net/url不接受非数字的端口, 请求需要通过NewServiceRequest或者ParseServiceURL构造
+type ServiceTransport struct {
+	Repo        *Repo
+	Base        http.RoundTripper //为nil时使用http.DefaultTransport
+	MaxAttempts int               //为0时使用DEFAULT_SERVICE_MAX_ATTEMPTS
+	UsePublicIP bool              //使用节点的PublicIP, 默认使用PrivateIp
+	HintHeader  string            //ctx没有WithPickHint时使用该请求头的值作为hint, 为空时不读取请求头
+}
+
+func NewServiceTransport(repo *Repo, base http.RoundTripper) *ServiceTransport {
+	model := new(ServiceTransport)
+	model.Repo = repo
+	model.Base = base
+	return model
+}
+
+func (this *ServiceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := this.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	service, portName, ok := splitServiceAddress(req.URL.Host)
+	if !ok || !this.Repo.isSubscribed(service) {
+		return base.RoundTrip(req)
+	}
+
+	maxAttempts := this.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DEFAULT_SERVICE_MAX_ATTEMPTS
+	}
+	//请求体不能重放时只尝试一次
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		maxAttempts = 1
+	}
+
+	hint := PickHint(req.Context())
+	if len(hint) == 0 && len(this.HintHeader) > 0 {
+		hint = req.Header.Get(this.HintHeader)
+	}
+
+	var lastErr error
+	tried := 0
+	//每次只选一个节点, 连接失败后才选下一个
+	picked := make(map[string]bool)
+	for tried < maxAttempts {
+		info, ok := this.Repo.pickExcept(service, hint, picked)
+		if !ok {
+			break
+		}
+		picked[info.UniqueId()] = true
+		addr, ok := serviceNodeAddress(&info, portName, this.UsePublicIP)
+		if !ok {
+			continue
+		}
+
+		outReq, err := rewriteServiceRequest(req, addr, tried > 0)
+		if err != nil {
+			return nil, err
+		}
+		tried++
+		this.Repo.Acquire(info)
+		resp, err := base.RoundTrip(outReq)
+		if err == nil {
+			this.Repo.ReportResult(service, info.Global.NodeId, nil)
+			resp.Body = newReleaseBody(resp.Body, func() {
+				this.Repo.Release(info)
+			})
+			return resp, nil
+		}
+		this.Repo.Release(info)
+		lastErr = err
+		if !isDialError(err) || req.Context().Err() != nil {
+			return nil, err
+		}
+		this.Repo.ReportResult(service, info.Global.NodeId, err)
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, fmt.Errorf("service %s has no available node with port %s", service, portName)
+}
+
+// 响应体关闭时调用release, 多次Close只调用一次
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+// 协议升级(101)的响应体可写, 包装后保留io.Writer
+type releaseReadWriteBody struct {
+	*releaseBody
+	io.Writer
+}
+
+func newReleaseBody(body io.ReadCloser, release func()) io.ReadCloser {
+	if body == nil {
+		release()
+		return nil
+	}
+	wrapped := &releaseBody{ReadCloser: body, release: release}
+	if writer, ok := body.(io.Writer); ok {
+		return &releaseReadWriteBody{releaseBody: wrapped, Writer: writer}
+	}
+	return wrapped
+}
+
+func (this *releaseBody) Close() error {
+	err := this.ReadCloser.Close()
+	this.once.Do(this.release)
+	return err
+}
+
+// 复制请求并替换目标地址, 重试时重新获取请求体
+func rewriteServiceRequest(req *http.Request, addr string, retry bool) (*http.Request, error) {
+	outReq := req.Clone(req.Context())
+	outReq.URL.Host = addr
+	//Host头默认为服务名:端口名, 没有意义, 改为实际地址
+	if req.Host == "" || req.Host == req.URL.Host {
+		outReq.Host = addr
+	}
+	if retry && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		outReq.Body = body
+	}
+	return outReq, nil
+}
+
+// 只有建立连接失败的错误可以安全地换节点重试
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// 拆分服务名和端口名, 端口名为空或者是数字时返回false
+func splitServiceAddress(address string) (string, string, bool) {
+	service, portName, ok := strings.Cut(address, ":")
+	if !ok || len(service) == 0 || len(portName) == 0 {
+		return "", "", false
+	}
+	if _, err := strconv.Atoi(portName); err == nil {
+		return "", "", false
+	}
+	return service, portName, true
+}
+
+// 节点的ip:port, 节点没有该端口或者没有对应的IP时返回false
+func serviceNodeAddress(info *RegisterInfo, portName string, usePublicIP bool) (string, bool) {
+	svcInfo := info.GetSvcInfo(portName)
+	if svcInfo == nil {
+		return "", false
+	}
+	ip := info.Global.PrivateIp
+	if usePublicIP {
+		ip = info.Global.PublicIP
+	}
+	if len(ip) == 0 {
+		return "", false
+	}
+	return net.JoinHostPort(ip, strconv.Itoa(svcInfo.Port)), true
+}
+
+func (this *Repo) isSubscribed(name string) bool {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+	return this.getSubsNodeList(name) != nil
+}
+
+// ParseServiceURL 解析端口为SvcInfo名字的url, 例如http://PushGateway:restful/path
+// 普通的url按url.Parse处理
+func ParseServiceURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err == nil {
+		return u, nil
+	}
+
+	scheme, rest, ok := strings.Cut(rawURL, "://")
+	if !ok {
+		return nil, err
+	}
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	authority := rest[:end]
+	service, _, ok := splitServiceAddress(authority)
+	if !ok {
+		return nil, err
+	}
+
+	u, err = url.Parse(scheme + "://" + service + rest[end:])
+	if err != nil {
+		return nil, err
+	}
+	u.Host = authority
+	return u, nil
+}
+
+// NewServiceRequest 同http.NewRequestWithContext, url的端口可以是SvcInfo的名字
+func NewServiceRequest(ctx context.Context, method string, rawURL string, body io.Reader) (*http.Request, error) {
+	u, err := ParseServiceURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://placeholder", body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = u
+	req.Host = u.Host
+	return req, nil
+}
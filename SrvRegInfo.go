@@ -24,6 +24,8 @@ type RegisterGlobalInfo struct {
 	PrivateIp string `json:"privateIP"`
 	PublicIP  string `json:"publicIP"`
 	Timestamp string `json:"timestamp"`
+	Zone      string `json:"zone,omitempty"`
+	Region    string `json:"region,omitempty"`
 }
 
 func (this *RegisterGlobalInfo) RefreshTimestamp(dt time.Time) {
@@ -0,0 +1,44 @@
+package srvDiscover
+
+import (
+	"sync/atomic"
+)
+
+// 注册相关的计数器, 供监控使用
+type repoStats struct {
+	grantSuccess     atomic.Int64
+	grantError       atomic.Int64
+	putSuccess       atomic.Int64
+	putError         atomic.Int64
+	keepaliveSuccess atomic.Int64
+	keepaliveError   atomic.Int64
+}
+
+// RepoStats 注册相关计数器的快照, 从repo创建开始累计
+type RepoStats struct {
+	GrantSuccess     int64
+	GrantError       int64
+	PutSuccess       int64
+	PutError         int64
+	KeepaliveSuccess int64 //收到的续约应答数
+	KeepaliveError   int64 //KeepAlive调用失败或者lease过期的次数
+}
+
+func (this *Repo) Stats() RepoStats {
+	return RepoStats{
+		GrantSuccess:     this.stats.grantSuccess.Load(),
+		GrantError:       this.stats.grantError.Load(),
+		PutSuccess:       this.stats.putSuccess.Load(),
+		PutError:         this.stats.putError.Load(),
+		KeepaliveSuccess: this.stats.keepaliveSuccess.Load(),
+		KeepaliveError:   this.stats.keepaliveError.Load(),
+	}
+}
+
+func countResult(err error, success *atomic.Int64, failure *atomic.Int64) {
+	if err != nil {
+		failure.Add(1)
+	} else {
+		success.Add(1)
+	}
+}
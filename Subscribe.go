@@ -10,10 +10,8 @@ package srvDiscover
 import (
 	"context"
 	"fmt"
-	"go.etcd.io/etcd/api/v3/mvccpb"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"log"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,15 +33,42 @@ type SrvNodeInfo struct {
 	ModRevision   int64
 	CacheUniqueId string
 	RegInfo       RegisterInfo
+
+	inflight atomic.Int64 //通过Acquire/Release上报的进行中请求数, 节点从缓存删除时一并丢弃
+	health   nodeHealth   //通过ReportResult上报的调用结果
+}
+
+// InFlight 进行中的请求数, 供自定义Picker使用
+func (this *SrvNodeInfo) InFlight() int64 {
+	return this.inflight.Load()
 }
 
 type SubSrvNodeList struct {
 	SubBasicInfo
 	NodeInfos []*SrvNodeInfo
+	Revision  int64 //最后一次同步到的etcd revision
+
+	cancel context.CancelFunc //停止watch协程, 为nil表示还没有启动
+	synced chan struct{}      //第一次全量同步成功后关闭
+
+	locality   SubscribeLocality
+	picker     Picker
+	hashPicker *ConsistentHashPicker //GetServiceByHashKey使用
+	pickNodes  []*SrvNodeInfo        //供picker选择的节点, 节点变化时重建
+
+	watchStatus watchStatus
 }
 
 type SubscribeOption struct {
 	Namespace string
+	Locality  SubscribeLocality
+}
+
+// SubscribeLocality 选择节点时优先本地Zone, 其次本地Region, 都不足MinNodes时使用全部节点
+type SubscribeLocality struct {
+	Zone     string
+	Region   string
+	MinNodes int //本地online节点少于该值时回退, 小于1时按1处理
 }
 
 //var defaultSubscribeOption SubscribeOption = SubscribeOption{
@@ -52,6 +77,16 @@ type SubscribeOption struct {
 
 type SubscribeOptionFunc func(subscribeOp *SubscribeOption)
 
+func WithSubscribeLocality(zone string, region string, minNodes int) SubscribeOptionFunc {
+	return func(subscribeOp *SubscribeOption) {
+		subscribeOp.Locality = SubscribeLocality{
+			Zone:     zone,
+			Region:   region,
+			MinNodes: minNodes,
+		}
+	}
+}
+
 //func WithSubscribeNamespace(namespace string) SubscribeOptionFunc {
 //	return func(subscribeOp *SubscribeOption) {
 //		subscribeOp.Namespace = namespace
@@ -75,6 +110,12 @@ watch的更新和get全部的更新 需要加锁
 watch的channel失败后，需要重新get全部一次
 */
 func (this *Repo) SubScribe(subSrvInfos []SubBasicInfo, subcribeOptions ...SubscribeOptionFunc) error {
+	return this.SubScribeContext(context.Background(), subSrvInfos, subcribeOptions...)
+}
+
+// SubScribeContext ctx结束或者repo被Close后watch协程退出
+// ctx结束时同Unsubscribe删除订阅, 之后可以重新订阅; repo被Close时保留缓存
+func (this *Repo) SubScribeContext(ctx context.Context, subSrvInfos []SubBasicInfo, subcribeOptions ...SubscribeOptionFunc) error {
 	serviceCount := len(subSrvInfos)
 	if serviceCount <= 0 {
 		return fmt.Errorf("subcribe names empty")
@@ -87,69 +128,235 @@ func (this *Repo) SubScribe(subSrvInfos []SubBasicInfo, subcribeOptions ...Subsc
 		op(subcribeOp)
 	}
 
+	this.initSubsNodeCache(subSrvInfos)
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
 	for srvName, srvNodeList := range this.subsNodeCache {
-		go this.watchSubs(srvName, srvNodeList, subcribeOp)
+		if srvNodeList.cancel != nil {
+			continue
+		}
+		err := this.startSubsWatcher(ctx, srvName, srvNodeList, subcribeOp)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Subscribe 运行时增加一个订阅并启动watch, Namespace为空时使用注册的namespace
+func (this *Repo) Subscribe(info SubBasicInfo, subcribeOptions ...SubscribeOptionFunc) error {
+	if len(info.Name) == 0 {
+		return fmt.Errorf("subscribe name is empty")
+	}
+	if len(info.Namespace) == 0 {
+		info.Namespace = DEFAULT_NAMESPACE
+		if this.config != nil && this.config.RegisterConf != nil {
+			info.Namespace = this.config.RegisterConf.Namespace
+		}
+	}
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if this.getSubsNodeList(info.Name) != nil {
+		return fmt.Errorf("service %s is already subscribed", info.Name)
+	}
+	subcribeOp := new(SubscribeOption)
+	for _, op := range subcribeOptions {
+		op(subcribeOp)
+	}
+
+	srvNodeList := newSubSrvNodeList(info)
+	err := this.startSubsWatcher(context.Background(), info.Name, srvNodeList, subcribeOp)
+	if err != nil {
+		return err
+	}
+	if this.subsNodeCache == nil {
+		this.subsNodeCache = make(map[string]*SubSrvNodeList)
+	}
+	this.subsNodeCache[info.Name] = srvNodeList
+	return nil
+}
+
+// Unsubscribe 停止watch并删除缓存, 缓存里的节点作为删除通知给OnServiceChange和WatchService
+// 已有的WatchService channel不会关闭, 重新Subscribe后继续收到事件
+func (this *Repo) Unsubscribe(name string) error {
+	this.locker.Lock()
+	var srvName string
+	var srvNodeList *SubSrvNodeList
+	for key, value := range this.subsNodeCache {
+		if strings.EqualFold(key, name) {
+			srvName = key
+			srvNodeList = value
+			break
+		}
+	}
+	if srvNodeList == nil {
+		this.locker.Unlock()
+		return fmt.Errorf("service %s is not subscribed", name)
+	}
+
+	change := this.removeSubsNodeList(srvName, srvNodeList)
+	this.locker.Unlock()
+
+	this.notifyServiceChange(change)
+	return nil
+}
+
+// 删除缓存并停止watch, 返回缓存节点的删除通知, 调用方需要持有locker
+func (this *Repo) removeSubsNodeList(srvName string, srvNodeList *SubSrvNodeList) *ServiceChange {
+	delete(this.subsNodeCache, srvName)
+	if srvNodeList.cancel != nil {
+		srvNodeList.cancel()
 	}
+	change := newServiceChange(srvNodeList.Name, srvNodeList.Revision)
+	for _, info := range srvNodeList.NodeInfos {
+		change.record(info, nodeRemoved)
+	}
+	return change
+}
+
+// watch协程退出时调用, 调用方的ctx结束后删除订阅, 避免继续使用不再更新的缓存
+// repo被Close时保留缓存; 已经被Unsubscribe或者重新订阅时不处理
+func (this *Repo) dropSubscription(srvName string, srvNodeList *SubSrvNodeList) {
+	this.lifeLocker.Lock()
+	closed := this.closed
+	this.lifeLocker.Unlock()
+	if closed {
+		return
+	}
+
+	this.locker.Lock()
+	if this.subsNodeCache[srvName] != srvNodeList {
+		this.locker.Unlock()
+		return
+	}
+	change := this.removeSubsNodeList(srvName, srvNodeList)
+	this.locker.Unlock()
+
+	this.notifyServiceChange(change)
+}
+
+// 启动订阅的watch协程, 调用方需要持有locker
+func (this *Repo) startSubsWatcher(ctx context.Context, srvName string, srvNodeList *SubSrvNodeList, subscribeOp *SubscribeOption) error {
+	if !this.beginRoutine() {
+		return fmt.Errorf("repo is closed")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	srvNodeList.cancel = cancel
+	srvNodeList.locality = subscribeOp.Locality
+	srvNodeList.refreshPickNodes(this.now())
+	go this.watchSubs(ctx, srvName, srvNodeList, subscribeOp)
 	return nil
 }
 
-func (this *Repo) watchSubs(srvName string, srvNodeList *SubSrvNodeList, subscribeOp *SubscribeOption) {
+func newSubSrvNodeList(info SubBasicInfo) *SubSrvNodeList {
+	srvNodeList := new(SubSrvNodeList)
+	srvNodeList.SubBasicInfo = *NewSubSrvBasicInfo(info.Name, info.Version, info.Namespace)
+	srvNodeList.NodeInfos = make([]*SrvNodeInfo, 0, 1)
+	srvNodeList.synced = make(chan struct{})
+	srvNodeList.picker = NewRoundRobinPicker()
+	srvNodeList.hashPicker = NewConsistentHashPicker(DEFAULT_HASH_REPLICAS)
+	return srvNodeList
+}
+
+// ctx结束时退出, 每轮watch使用独立的ctx, 失败时只取消自己的watch而不影响其它订阅
+func (this *Repo) watchSubs(ctx context.Context, srvName string, srvNodeList *SubSrvNodeList, subscribeOp *SubscribeOption) {
+	defer this.routineWg.Done()
+	defer this.dropSubscription(srvName, srvNodeList)
+
+	ctx, cancel, err := this.bindContext(ctx)
+	if err != nil {
+		return
+	}
+	defer cancel()
+
 	servicePrefix := fmt.Sprintf("/registry.%s.%s", srvNodeList.Namespace, srvName)
 	backoff := time.Second
 	maxBackoff := 15 * time.Second
 
-	for {
-		log.Printf("etcd client start watch prefix:%s\n", servicePrefix)
-		watchChan := this.client.Watch(clientv3.WithRequireLeader(context.TODO()), servicePrefix, clientv3.WithPrefix())
+	status := &srvNodeList.watchStatus
+	defer status.setConnected(false)
 
-		//watch后必须进行一次成功的全查询
-		err := this.getAll(srvName, srvNodeList)
+	for ctx.Err() == nil {
+		//先全量查询, 再从查询的下一个revision开始watch, 中间的变化不会丢失
+		revision, err := this.getAll(ctx, srvName, srvNodeList)
 		if err != nil {
-			log.Printf("etcd client Initial watch subs get all failed: %v\n", err)
-			this.client.Watcher.Close()
-			time.Sleep(backoff)
+			if ctx.Err() != nil {
+				return
+			}
+			this.log().Warn("watch initial get failed", LOG_KEY_SERVICE, srvName, LOG_KEY_NAMESPACE, srvNodeList.Namespace,
+				"backoff", backoff, LOG_KEY_ERROR, err)
+			status.fail(err)
+			status.restart(backoff)
+			sleepContext(ctx, backoff)
 			backoff = min(backoff*2, maxBackoff)
 			continue
 		}
 
 		// Reset backoff after a successful fetch
 		backoff = time.Second
+		status.setConnected(true)
+
+		this.log().Info("start watch service", LOG_KEY_SERVICE, srvName, LOG_KEY_NAMESPACE, srvNodeList.Namespace, LOG_KEY_REVISION, revision+1)
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		watchChan := this.backend.WatchPrefix(watchCtx, servicePrefix, revision+1)
 
 		//fmt.Println("watch begin ...")
 		for watchResponse := range watchChan {
-			if watchResponse.Err() != nil {
-				log.Printf("etcd client watch event error:%s\n", watchResponse.Err())
-				this.client.Watcher.Close()
-				time.Sleep(backoff)
-				backoff = min(backoff*2, maxBackoff)
+			if watchResponse.Err != nil {
+				this.log().Warn("watch event error", LOG_KEY_SERVICE, srvName, LOG_KEY_NAMESPACE, srvNodeList.Namespace,
+					LOG_KEY_REVISION, watchResponse.Revision, LOG_KEY_ERROR, watchResponse.Err)
+				status.fail(watchResponse.Err)
 				break
 			}
-
-			this.updateByEvents(srvNodeList, watchResponse.Events)
+			status.receive()
+			this.updateByEvents(ctx, srvNodeList, watchResponse.Events, watchResponse.Revision)
+		}
+		watchCancel()
+		if ctx.Err() != nil {
+			return
 		}
 		//watchChan被关闭
-		log.Printf("etcd client  Recreating watcher for prefix: %s\n", servicePrefix)
-		time.Sleep(backoff)
+		this.log().Info("recreate watch service", LOG_KEY_SERVICE, srvName, LOG_KEY_NAMESPACE, srvNodeList.Namespace, "backoff", backoff)
+		status.restart(backoff)
+		sleepContext(ctx, backoff)
 		backoff = min(backoff*2, maxBackoff)
 	}
 }
 
-func (this *Repo) getAll(srvName string, srvNodeList *SubSrvNodeList) error {
+// 全量同步服务节点, 返回查询时的revision
+func (this *Repo) getAll(ctx context.Context, srvName string, srvNodeList *SubSrvNodeList) (revision int64, err error) {
+	ctx, span := this.startSpan(ctx, "srvDiscover.Resync", ATTR_SERVICE.String(srvName), ATTR_NAMESPACE.String(srvNodeList.Namespace))
+	defer func() {
+		endSpan(span, err)
+	}()
+
 	servicePrefix := fmt.Sprintf("/registry.%s.%s", srvNodeList.Namespace, srvName)
-	getResponse, err := this.client.Get(context.TODO(), servicePrefix, clientv3.WithPrefix())
+	var kvs []KeyValue
+	kvs, revision, err = this.backend.GetPrefix(ctx, servicePrefix)
+	span.SetAttributes(ATTR_REVISION.Int64(revision), ATTR_NODE_COUNT.Int(len(kvs)))
 	if err != nil {
-		log.Printf("client get error:%s\n", err.Error())
-		return err
+		this.log().Warn("get service nodes failed", LOG_KEY_SERVICE, srvName, LOG_KEY_NAMESPACE, srvNodeList.Namespace, LOG_KEY_ERROR, err)
+		return 0, err
 	}
 
-	this.locker.Lock()
-	defer this.locker.Unlock()
+	change := newServiceChange(srvNodeList.Name, revision)
+	change.Resync = true
 
-	existKeyList := make([]string, 0, len(getResponse.Kvs))
+	this.locker.Lock()
+	//已经取消订阅, Unsubscribe在locker内取消ctx
+	if ctx.Err() != nil {
+		this.locker.Unlock()
+		return 0, ctx.Err()
+	}
+	existKeyList := make([]string, 0, len(kvs))
 	//更新插入
-	for _, kv := range getResponse.Kvs {
-		existKeyList = append(existKeyList, string(kv.Key))
-		upsertNodeList(kv, srvNodeList)
+	for idx := range kvs {
+		existKeyList = append(existKeyList, string(kvs[idx].Key))
+		change.record(this.upsertNode(&kvs[idx], srvNodeList))
 	}
 
 	//删除
@@ -158,45 +365,87 @@ func (this *Repo) getAll(srvName string, srvNodeList *SubSrvNodeList) error {
 		if arrayKeyMatchUniqueId(existKeyList, srvNodeList.NodeInfos[idx].CacheUniqueId) >= 0 {
 			srvNodeList.NodeInfos[m] = srvNodeList.NodeInfos[idx]
 			m++
+		} else {
+			change.record(srvNodeList.NodeInfos[idx], nodeRemoved)
 		}
 	}
 	srvNodeList.NodeInfos = srvNodeList.NodeInfos[:m]
-	return nil
+	srvNodeList.Revision = max(srvNodeList.Revision, revision)
+	srvNodeList.refreshPickNodes(this.now())
+	srvNodeList.markSynced()
+	this.locker.Unlock()
+
+	this.notifyServiceChange(change)
+	return revision, nil
 }
 
-func (this *Repo) updateByEvents(srvNodeList *SubSrvNodeList, events []*clientv3.Event) {
-	this.locker.Lock()
-	defer this.locker.Unlock()
+func (this *Repo) updateByEvents(ctx context.Context, srvNodeList *SubSrvNodeList, events []Event, revision int64) {
+	change := newServiceChange(srvNodeList.Name, revision)
 
-	for _, event := range events {
+	this.locker.Lock()
+	if ctx.Err() != nil {
+		this.locker.Unlock()
+		return
+	}
+	for idx := range events {
+		event := &events[idx]
 		switch event.Type {
-		case mvccpb.PUT:
+		case EventPut:
 			//fmt.Println("put event ...")
-			upsertNodeList(event.Kv, srvNodeList)
+			change.record(this.upsertNode(&event.Kv, srvNodeList))
 			break
-		case mvccpb.DELETE:
+		case EventDelete:
 			//fmt.Println("delete event ...")
 			key := string(event.Kv.Key)
 			modRevision := event.Kv.ModRevision
-			srvNodeList.NodeInfos = removeNode(srvNodeList.NodeInfos, key, modRevision)
+			var removed []*SrvNodeInfo
+			srvNodeList.NodeInfos, removed = removeNode(srvNodeList.NodeInfos, key, modRevision)
+			for _, info := range removed {
+				change.record(info, nodeRemoved)
+			}
 			break
 		}
 	}
+	srvNodeList.Revision = max(srvNodeList.Revision, revision)
+	if !change.Empty() {
+		srvNodeList.refreshPickNodes(this.now())
+	}
+	this.locker.Unlock()
+
+	this.notifyServiceChange(change)
 }
 
-func removeNode(infos []*SrvNodeInfo, key string, modRevision int64) []*SrvNodeInfo {
+// 返回保留的和被删除的节点
+func removeNode(infos []*SrvNodeInfo, key string, modRevision int64) ([]*SrvNodeInfo, []*SrvNodeInfo) {
+	var removed []*SrvNodeInfo
 	m := 0
 	for idx := range infos {
 		s := infos[idx]
 		if !checkKeyMatchNodeInfo(key, s.CacheUniqueId) || modRevision <= s.ModRevision {
 			infos[m] = s
 			m++
+		} else {
+			removed = append(removed, s)
 		}
 	}
-	return infos[:m]
+	return infos[:m], removed
+}
+
+// 更新插入节点并记录日志
+func (this *Repo) upsertNode(kv *KeyValue, srvNodeList *SubSrvNodeList) (*SrvNodeInfo, nodeChangeType) {
+	info, changeType, err := upsertNodeList(kv, srvNodeList)
+	if err != nil {
+		this.log().Warn("decode service node failed", LOG_KEY_SERVICE, srvNodeList.Name, LOG_KEY_KEY, string(kv.Key),
+			LOG_KEY_REVISION, kv.ModRevision, LOG_KEY_ERROR, err)
+	} else if changeType == nodeAdded {
+		this.log().Debug("add service node", LOG_KEY_SERVICE, srvNodeList.Name, LOG_KEY_NODE_ID, info.RegInfo.Global.NodeId,
+			"version", info.RegInfo.Global.Version, LOG_KEY_REVISION, kv.ModRevision)
+	}
+	return info, changeType
 }
 
-func upsertNodeList(kv *mvccpb.KeyValue, srvNodeList *SubSrvNodeList) {
+// 返回变化的节点和变化类型, 没有变化时返回nodeUnchanged, 反序列化失败时返回错误
+func upsertNodeList(kv *KeyValue, srvNodeList *SubSrvNodeList) (*SrvNodeInfo, nodeChangeType, error) {
 	key := string(kv.Key)
 	valueBytes := kv.Value
 	modRevision := kv.ModRevision
@@ -207,34 +456,32 @@ func upsertNodeList(kv *mvccpb.KeyValue, srvNodeList *SubSrvNodeList) {
 		}
 
 		if info.ModRevision >= modRevision {
-			return
+			return nil, nodeUnchanged, nil
 		}
 
 		updateInfo := new(SrvNodeInfo)
 		err := updateInfo.RegInfo.Deserialize(valueBytes)
 		if err != nil {
-			log.Printf("SrvNodeInfo unmarshal error:%s\r\n", err.Error())
-			return
+			return nil, nodeUnchanged, err
 		}
 		info.RegInfo = updateInfo.RegInfo
 		info.ModRevision = modRevision
-		return
+		return info, nodeUpdated, nil
 	}
 
 	newInfo := new(SrvNodeInfo)
 	err := newInfo.RegInfo.Deserialize(valueBytes)
 	if err != nil {
-		log.Printf("SrvNodeInfo unmarshal error:%s\r\n", err.Error())
-		return
+		return nil, nodeUnchanged, err
 	}
 	newInfo.ModRevision = modRevision
 	newInfo.CacheUniqueId = newInfo.RegInfo.UniqueId()
 
 	if len(srvNodeList.Version) > 0 && newInfo.RegInfo.Global.Version != srvNodeList.Version {
-		return
+		return nil, nodeUnchanged, nil
 	}
 	srvNodeList.NodeInfos = append(srvNodeList.NodeInfos, newInfo)
-	fmt.Printf("add node %s %s\n", newInfo.RegInfo.Global.Name, newInfo.RegInfo.Global.Version)
+	return newInfo, nodeAdded, nil
 }
 
 func arrayKeyMatchUniqueId(array []string, id string) (index int) {
@@ -253,7 +500,7 @@ func checkKeyMatchNodeInfo(key string, id string) bool {
 }
 
 func (this *Repo) PrintAll() {
-	this.locker.Lock()
+	this.locker.RLock()
 	for srvName, srvNodeList := range this.subsNodeCache {
 		fmt.Printf("-------------------- srv:%s ver:%s len:%d\n", srvName, srvNodeList.Version, len(srvNodeList.NodeInfos))
 		for _, node := range srvNodeList.NodeInfos {
@@ -262,7 +509,7 @@ func (this *Repo) PrintAll() {
 		}
 	}
 
-	this.locker.Unlock()
+	this.locker.RUnlock()
 }
 
 //func (this *ServiceDiscovery) Discover2(serviceEntry ...IServiceEntry) {
@@ -0,0 +1,62 @@
+package srvDiscover
+
+import (
+	"testing"
+)
+
+func newTestKv(name string, nodeId string, version string, modRevision int64) *KeyValue {
+	info := new(RegisterInfo)
+	info.Global.Name = name
+	info.Global.NodeId = nodeId
+	info.Global.Version = version
+	info.Global.PrivateIp = "127.0.0.1"
+	info.Global.State = STATE_ONLINE
+	return &KeyValue{
+		Key:         []byte(info.FormatRegisterKey(DEFAULT_NAMESPACE)),
+		Value:       info.Serialize(),
+		ModRevision: modRevision,
+	}
+}
+
+func Test_upsertNodeListRevision(t *testing.T) {
+	nodeList := new(SubSrvNodeList)
+
+	upsertNodeList(newTestKv("svc", "n1", "v2", 5), nodeList)
+	if len(nodeList.NodeInfos) != 1 {
+		t.Fatalf("node count %d", len(nodeList.NodeInfos))
+	}
+
+	//旧revision不覆盖缓存
+	upsertNodeList(newTestKv("svc", "n1", "v1", 3), nodeList)
+	if nodeList.NodeInfos[0].RegInfo.Global.Version != "v2" || nodeList.NodeInfos[0].ModRevision != 5 {
+		t.Fatalf("older revision overwrote cache: %+v", nodeList.NodeInfos[0])
+	}
+
+	upsertNodeList(newTestKv("svc", "n1", "v3", 8), nodeList)
+	if nodeList.NodeInfos[0].RegInfo.Global.Version != "v3" || nodeList.NodeInfos[0].ModRevision != 8 {
+		t.Fatalf("newer revision not applied: %+v", nodeList.NodeInfos[0])
+	}
+
+	//旧revision的删除不生效
+	kv := newTestKv("svc", "n1", "", 7)
+	nodeList.NodeInfos, _ = removeNode(nodeList.NodeInfos, string(kv.Key), kv.ModRevision)
+	if len(nodeList.NodeInfos) != 1 {
+		t.Fatalf("older delete removed node")
+	}
+	kv.ModRevision = 9
+	nodeList.NodeInfos, _ = removeNode(nodeList.NodeInfos, string(kv.Key), kv.ModRevision)
+	if len(nodeList.NodeInfos) != 0 {
+		t.Fatalf("newer delete not applied")
+	}
+}
+
+func Test_upsertNodeListVersionFilter(t *testing.T) {
+	nodeList := new(SubSrvNodeList)
+	nodeList.Version = "v1"
+
+	upsertNodeList(newTestKv("svc", "n1", "v1", 1), nodeList)
+	upsertNodeList(newTestKv("svc", "n2", "v2", 2), nodeList)
+	if len(nodeList.NodeInfos) != 1 || nodeList.NodeInfos[0].RegInfo.Global.NodeId != "n1" {
+		t.Fatalf("version filter not applied: %d", len(nodeList.NodeInfos))
+	}
+}
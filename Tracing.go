@@ -0,0 +1,55 @@
+package srvDiscover
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"sync/atomic"
+)
+
+// TRACER_NAME 创建span使用的tracer名称
+const TRACER_NAME = "github.com/xukgo/srvDiscover"
+
+// span的属性名
+const (
+	ATTR_SERVICE     = attribute.Key("srvdiscover.service")
+	ATTR_NAMESPACE   = attribute.Key("srvdiscover.namespace")
+	ATTR_REVISION    = attribute.Key("srvdiscover.revision")
+	ATTR_NODE_ID     = attribute.Key("srvdiscover.node_id")
+	ATTR_KEY         = attribute.Key("srvdiscover.key")
+	ATTR_LEASE_GROUP = attribute.Key("srvdiscover.lease_group")
+	ATTR_NODE_COUNT  = attribute.Key("srvdiscover.node_count")
+)
+
+// repo使用的TracerProvider, 没有设置时跟随otel.GetTracerProvider(), 默认不产生span
+type repoTracer struct {
+	provider atomic.Pointer[trace.TracerProvider]
+}
+
+// WithTracerProvider 设置repo创建span使用的TracerProvider, 为nil时恢复为otel全局的provider
+func (this *Repo) WithTracerProvider(provider trace.TracerProvider) {
+	if provider == nil {
+		this.tracer.provider.Store(nil)
+		return
+	}
+	this.tracer.provider.Store(&provider)
+}
+
+func (this *Repo) startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	provider := otel.GetTracerProvider()
+	if p := this.tracer.provider.Load(); p != nil {
+		provider = *p
+	}
+	return provider.Tracer(TRACER_NAME).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// 记录错误后结束span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,101 @@
+package srvDiscover
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/gsaber/utils/stringUtil"
+)
+
+// 调用方需要持有locker写锁
+func (this *SubSrvNodeList) markSynced() {
+	if this.synced == nil {
+		return
+	}
+	select {
+	case <-this.synced:
+	default:
+		close(this.synced)
+	}
+}
+
+// WaitSynced 阻塞直到当前所有订阅的服务都完成第一次全量同步
+// ctx结束或者repo被Close时返回错误
+func (this *Repo) WaitSynced(ctx context.Context) error {
+	ctx, cancel, err := this.bindContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	this.locker.RLock()
+	chans := make([]chan struct{}, 0, len(this.subsNodeCache))
+	for _, srvNodeList := range this.subsNodeCache {
+		chans = append(chans, srvNodeList.synced)
+	}
+	this.locker.RUnlock()
+
+	for _, synced := range chans {
+		select {
+		case <-synced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// WaitForInstances 阻塞直到服务完成第一次全量同步, 并且online的节点数不少于min
+// 服务没有订阅时返回错误, ctx结束或者repo被Close时返回ctx的错误
+func (this *Repo) WaitForInstances(ctx context.Context, name string, min int) error {
+	ctx, cancel, err := this.bindContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
+	signal := make(chan struct{}, 1)
+	cancelListener := this.OnServiceChange(name, func(change ServiceChange) {
+		select {
+		case signal <- struct{}{}:
+		default:
+		}
+	})
+	defer cancelListener()
+
+	for {
+		this.locker.RLock()
+		srvNodeList := this.getSubsNodeList(name)
+		var synced chan struct{}
+		count := 0
+		if srvNodeList != nil {
+			synced = srvNodeList.synced
+			for _, info := range srvNodeList.NodeInfos {
+				if stringUtil.CompareIgnoreCase(info.RegInfo.Global.State, STATE_ONLINE) {
+					count++
+				}
+			}
+		}
+		this.locker.RUnlock()
+
+		if srvNodeList == nil {
+			return fmt.Errorf("service %s is not subscribed", name)
+		}
+
+		select {
+		case <-synced:
+			if count >= min {
+				return nil
+			}
+			//已经同步, 只需要等待节点变化
+			synced = nil
+		default:
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-synced:
+		case <-signal:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package srvDiscover
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/gsaber/utils/stringUtil"
+	"sync"
+)
+
+// WatchService最多积压的事件数, 超过后丢弃积压事件, 改为发送一个最新快照
+const WATCH_SERVICE_BUFFER = 64
+
+type ServiceEventType int
+
+const (
+	ServiceEventSnapshot ServiceEventType = iota //Nodes为当前全部节点
+	ServiceEventPut                              //Nodes为新增或者更新的节点
+	ServiceEventDelete                           //Nodes为删除的节点
+)
+
+// ServiceEvent WatchService推送的事件, Nodes包含所有状态的节点, 由使用方按State过滤
+type ServiceEvent struct {
+	Type     ServiceEventType
+	Service  string
+	Revision int64
+	Nodes    []RegisterInfo
+}
+
+type serviceWatcher struct {
+	repo    *Repo
+	name    string
+	signal  chan struct{}
+	locker  sync.Mutex
+	pending []ServiceEvent
+	resync  bool //需要发送快照
+}
+
+// WatchService 以channel的方式订阅服务变化, 先推送当前快照, 之后推送增量的Put/Delete事件
+// 事件来源与OnServiceChange相同; 使用方处理过慢导致积压超过WATCH_SERVICE_BUFFER时,
+// 积压的事件被丢弃并合并为一个最新快照, 快照之后的事件可能与快照内容重复
+// ctx结束或者repo被Close后channel关闭
+func (this *Repo) WatchService(ctx context.Context, name string) (<-chan ServiceEvent, error) {
+	this.locker.RLock()
+	srvNodeList := this.getSubsNodeList(name)
+	this.locker.RUnlock()
+	if srvNodeList == nil {
+		return nil, fmt.Errorf("service %s is not subscribed", name)
+	}
+	if !this.beginRoutine() {
+		return nil, fmt.Errorf("repo is closed")
+	}
+
+	watcher := &serviceWatcher{
+		repo:   this,
+		name:   name,
+		signal: make(chan struct{}, 1),
+		resync: true,
+	}
+	watcher.notify()
+	cancelListener := this.OnServiceChange(name, watcher.onChange)
+
+	out := make(chan ServiceEvent)
+	go func() {
+		defer this.routineWg.Done()
+		defer close(out)
+		defer cancelListener()
+
+		ctx, cancel, err := this.bindContext(ctx)
+		if err != nil {
+			return
+		}
+		defer cancel()
+
+		watcher.run(ctx, out)
+	}()
+	return out, nil
+}
+
+// 查找订阅的服务缓存, 名字不区分大小写, 调用方需要持有locker
+func (this *Repo) getSubsNodeList(name string) *SubSrvNodeList {
+	for srvName, srvNodeList := range this.subsNodeCache {
+		if stringUtil.CompareIgnoreCase(srvName, name) {
+			return srvNodeList
+		}
+	}
+	return nil
+}
+
+func (this *serviceWatcher) notify() {
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (this *serviceWatcher) onChange(change ServiceChange) {
+	this.locker.Lock()
+	if !this.resync {
+		if len(change.Added) > 0 || len(change.Updated) > 0 {
+			nodes := make([]RegisterInfo, 0, len(change.Added)+len(change.Updated))
+			nodes = append(nodes, change.Added...)
+			nodes = append(nodes, change.Updated...)
+			this.pending = append(this.pending, ServiceEvent{Type: ServiceEventPut, Service: change.Service, Revision: change.Revision, Nodes: nodes})
+		}
+		if len(change.Removed) > 0 {
+			this.pending = append(this.pending, ServiceEvent{Type: ServiceEventDelete, Service: change.Service, Revision: change.Revision, Nodes: change.Removed})
+		}
+		if len(this.pending) > WATCH_SERVICE_BUFFER {
+			this.pending = nil
+			this.resync = true
+		}
+	}
+	this.locker.Unlock()
+	this.notify()
+}
+
+// 取出待发送的事件, 需要快照时丢弃积压事件并生成快照
+func (this *serviceWatcher) take() []ServiceEvent {
+	repo := this.repo
+	repo.locker.RLock()
+	defer repo.locker.RUnlock()
+
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if !this.resync {
+		events := this.pending
+		this.pending = nil
+		return events
+	}
+
+	this.resync = false
+	this.pending = nil
+	snapshot := ServiceEvent{Type: ServiceEventSnapshot, Service: this.name}
+	srvNodeList := repo.getSubsNodeList(this.name)
+	if srvNodeList != nil {
+		snapshot.Service = srvNodeList.Name
+		snapshot.Revision = srvNodeList.Revision
+		snapshot.Nodes = make([]RegisterInfo, 0, len(srvNodeList.NodeInfos))
+		for _, info := range srvNodeList.NodeInfos {
+			snapshot.Nodes = append(snapshot.Nodes, info.RegInfo.DeepClone(true))
+		}
+	}
+	return []ServiceEvent{snapshot}
+}
+
+func (this *serviceWatcher) run(ctx context.Context, out chan<- ServiceEvent) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-this.signal:
+		}
+
+		for _, event := range this.take() {
+			select {
+			case out <- event:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
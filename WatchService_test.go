@@ -0,0 +1,28 @@
+package srvDiscover
+
+import (
+	"testing"
+)
+
+func Test_serviceWatcherOverflow(t *testing.T) {
+	repo := new(Repo)
+	repo.initSubsNodeCache([]SubBasicInfo{*NewSubSrvBasicInfo("svc", "", DEFAULT_NAMESPACE)})
+	upsertNodeList(newTestKv("svc", "n1", "v1", 1), repo.subsNodeCache["svc"])
+
+	watcher := &serviceWatcher{repo: repo, name: "svc", signal: make(chan struct{}, 1)}
+	change := ServiceChange{Service: "svc", Added: []RegisterInfo{{}}}
+	watcher.onChange(change)
+	events := watcher.take()
+	if len(events) != 1 || events[0].Type != ServiceEventPut {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	//积压超过上限后合并为快照
+	for i := 0; i <= WATCH_SERVICE_BUFFER; i++ {
+		watcher.onChange(change)
+	}
+	events = watcher.take()
+	if len(events) != 1 || events[0].Type != ServiceEventSnapshot || len(events[0].Nodes) != 1 {
+		t.Fatalf("unexpected events after overflow: %+v", events)
+	}
+}
@@ -0,0 +1,79 @@
+package srvDiscover
+
+import (
+	"sync"
+	"time"
+)
+
+// 订阅watch协程的运行状态, 由watch协程更新, 使用自己的锁而不是repo的locker
+type watchStatus struct {
+	locker      sync.Mutex
+	connected   bool
+	restarts    int64
+	backoff     time.Duration
+	lastError   string
+	lastErrorAt time.Time
+	lastEventAt time.Time
+}
+
+func (this *watchStatus) setConnected(connected bool) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.connected = connected
+	if connected {
+		this.backoff = 0
+	}
+}
+
+func (this *watchStatus) fail(err error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.lastError = err.Error()
+	this.lastErrorAt = time.Now()
+}
+
+// 重新watch之前调用, backoff为本次等待的时长
+func (this *watchStatus) restart(backoff time.Duration) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.connected = false
+	this.restarts++
+	this.backoff = backoff
+}
+
+func (this *watchStatus) receive() {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.lastEventAt = time.Now()
+}
+
+// WatchStatusInfo watch协程状态的快照
+type WatchStatusInfo struct {
+	Connected   bool          `json:"connected"`
+	Restarts    int64         `json:"restarts"`
+	Backoff     time.Duration `json:"backoff"` //正在等待的重连间隔, 已连接时为0
+	LastError   string        `json:"lastError,omitempty"`
+	LastErrorAt *time.Time    `json:"lastErrorAt,omitempty"`
+	LastEventAt *time.Time    `json:"lastEventAt,omitempty"`
+}
+
+func (this *watchStatus) snapshot() WatchStatusInfo {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	return WatchStatusInfo{
+		Connected:   this.connected,
+		Restarts:    this.restarts,
+		Backoff:     this.backoff,
+		LastError:   this.lastError,
+		LastErrorAt: optionalTime(this.lastErrorAt),
+		LastEventAt: optionalTime(this.lastEventAt),
+	}
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
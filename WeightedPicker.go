@@ -0,0 +1,99 @@
+package srvDiscover
+
+import (
+	"math/rand"
+)
+
+// 负载最高的节点仍然保留的权重, 避免所有节点满载时没有节点可选
+const MIN_PICK_WEIGHT = 1.0
+
+// WeightFunc 根据节点上报的负载计算选择权重, 返回值小于等于0的节点不会被选中
+type WeightFunc func(profile RegisterProfileInfo) float64
+
+// ProfileWeights 各负载项在计算负载时的占比, 负载值按使用率(0-100)理解
+type ProfileWeights struct {
+	Cpu    float64
+	IO     float64
+	Disk   float64
+	Memory float64
+	Socket float64
+}
+
+var DefaultProfileWeights = ProfileWeights{
+	Cpu:    1,
+	Memory: 1,
+}
+
+// Weight 按占比加权平均得到负载, 权重为100减去负载, 最小为MIN_PICK_WEIGHT
+func (this ProfileWeights) Weight(profile RegisterProfileInfo) float64 {
+	total := this.Cpu + this.IO + this.Disk + this.Memory + this.Socket
+	if total <= 0 {
+		return MIN_PICK_WEIGHT
+	}
+
+	load := this.Cpu*clampUsage(profile.Cpu) +
+		this.IO*clampUsage(profile.IO) +
+		this.Disk*clampUsage(profile.Disk) +
+		this.Memory*clampUsage(profile.Memory) +
+		this.Socket*clampUsage(profile.Socket)
+	return max(100-load/total, MIN_PICK_WEIGHT)
+}
+
+func clampUsage(value int) float64 {
+	return float64(min(max(value, 0), 100))
+}
+
+// WeightedPicker 按负载计算的权重随机选择, 负载低的节点被选中的概率更高
+// 注册方在BeforeRegisterFunc里填充RegisterInfo.Profile
+type WeightedPicker struct {
+	weightFunc WeightFunc
+}
+
+// NewWeightedPicker 按各负载项的占比计算权重
+func NewWeightedPicker(weights ProfileWeights) *WeightedPicker {
+	return NewWeightedPickerFunc(weights.Weight)
+}
+
+// NewWeightedPickerFunc 使用自定义的权重公式
+func NewWeightedPickerFunc(weightFunc WeightFunc) *WeightedPicker {
+	model := new(WeightedPicker)
+	model.weightFunc = weightFunc
+	return model
+}
+
+func (this *WeightedPicker) Pick(nodes []*SrvNodeInfo, hint string) *SrvNodeInfo {
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	weights := make([]float64, len(nodes))
+	total := 0.0
+	for idx, info := range nodes {
+		weight := this.weightFunc(info.RegInfo.Profile)
+		if weight > 0 {
+			weights[idx] = weight
+			total += weight
+		}
+	}
+	if total <= 0 {
+		return nil
+	}
+
+	value := rand.Float64() * total
+	for idx, weight := range weights {
+		if weight <= 0 {
+			continue
+		}
+		value -= weight
+		if value < 0 {
+			return nodes[idx]
+		}
+	}
+	//浮点误差时返回最后一个有权重的节点
+	for idx := len(nodes) - 1; idx >= 0; idx-- {
+		if weights[idx] > 0 {
+			return nodes[idx]
+		}
+	}
+	return nil
+}
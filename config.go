@@ -34,6 +34,8 @@ type ConfRoot struct {
 	ClientTls     *ClientTlsConfig `xml:"Tls"`            //
 	RegisterConf  *RegisterConf    `xml:"Register"`
 	SubScribeConf *SubscribeConf   `xml:"Subscribe"`
+
+	ExtraRegisterConfs []*RegisterConf `xml:"Registers>Register"` //额外的注册项, 每项有独立的key和状态
 }
 
 type ClientTlsConfig struct {
@@ -43,11 +45,12 @@ type ClientTlsConfig struct {
 }
 
 type RegisterConf struct {
-	Interval  int                     `xml:"Interval"`  //注册间隔, 单位秒, 默认值为2
-	TTL       int                     `xml:"TTL"`       //注册服务的TimeToLive, 单位秒,默认值为6
-	Namespace string                  `xml:"Namespace"` //注册Key的namespace, 默认为voice, /registry/namespace/..
-	Global    RegisterGlobalConf      `xml:"Global"`
-	SvcInfos  []RegisterSvcDefineConf `xml:"SvcInfos>Svc"`
+	Interval   int                     `xml:"Interval"`   //注册间隔, 单位秒, 默认值为2
+	TTL        int                     `xml:"TTL"`        //注册服务的TimeToLive, 单位秒,默认值为6
+	Namespace  string                  `xml:"Namespace"`  //注册Key的namespace, 默认为voice, /registry/namespace/..
+	LeaseGroup string                  `xml:"LeaseGroup"` //相同分组的注册共用一个lease, 为空则独占
+	Global     RegisterGlobalConf      `xml:"Global"`
+	SvcInfos   []RegisterSvcDefineConf `xml:"SvcInfos>Svc"`
 	//PrivateMap []SrvRegisterPrivateConf `xml:"PrivateMap>Private"`
 }
 
@@ -60,6 +63,8 @@ type RegisterGlobalConf struct {
 	PrivateIP       string `xml:"-"`
 	PublicIPString  string `xml:"PublicIP"`
 	PublicIP        string `xml:"-"`
+	Zone            string `xml:"Zone"`   //可用区, 可选
+	Region          string `xml:"Region"` //地域/机房, 可选
 }
 
 type RegisterSvcDefineConf struct {
@@ -75,13 +80,16 @@ func (this *RegisterSvcDefineConf) DeepClone() *RegisterSvcDefineConf {
 }
 
 type SubscribeSrvConf struct {
-	Namespace string `xml:"Namespace"`
-	Name      string `xml:"Name"`
-	Version   string `xml:"Version"`
+	Namespace string        `xml:"Namespace"`
+	Name      string        `xml:"Name"`
+	Version   string        `xml:"Version"`
+	Balancer  *BalancerConf `xml:"Balancer"`
 }
 
 type SubscribeConf struct {
-	Services []SubscribeSrvConf `xml:"Service"`
+	PreferLocalZone bool               `xml:"PreferLocalZone"` //优先选择与Register相同Zone/Region的节点
+	MinZoneNodes    int                `xml:"MinZoneNodes"`    //本地online节点少于该值时使用其它Zone的节点, 默认为1
+	Services        []SubscribeSrvConf `xml:"Service"`
 }
 
 func (c *SubscribeConf) GetIndexByName(name string) int {
@@ -107,36 +115,19 @@ func (this *ConfRoot) FillWithXml(data []byte) error {
 	}
 
 	if this.RegisterConf != nil {
-		this.RegisterConf.Namespace = strings.TrimSpace(this.RegisterConf.Namespace)
-		if len(this.RegisterConf.Namespace) == 0 {
-			this.RegisterConf.Namespace = defaultRegisterOption.Namespace
-		}
-		if this.RegisterConf.TTL == 0 {
-			this.RegisterConf.TTL = int(defaultRegisterOption.TTLSec)
-		}
-		if this.RegisterConf.Interval == 0 {
-			this.RegisterConf.Interval = int(defaultRegisterOption.Interval / time.Second)
-		}
-
-		//PrivateIP
-		ip, err := convertRegisterIP(this.RegisterConf.Global.PrivateIPString)
+		err = this.RegisterConf.fill()
 		if err != nil {
 			return err
 		}
-		this.RegisterConf.Global.PrivateIP = ip
-
-		//PublicIP
-		ip, err = convertRegisterIP(this.RegisterConf.Global.PublicIPString)
-		if err == nil {
-			this.RegisterConf.Global.PublicIP = ip
-		}
-
-		if len(this.RegisterConf.Global.NodeId) == 0 {
-			this.RegisterConf.Global.NodeId = uuid.NewV1().String()
-		}
 
 		this.Endpoints = arrayUtil.StringsTrimSpaceFilterEmpty(this.Endpoints)
 	}
+	for idx := range this.ExtraRegisterConfs {
+		err = this.ExtraRegisterConfs[idx].fill()
+		if err != nil {
+			return err
+		}
+	}
 
 	if this.SubScribeConf != nil {
 		for idx := range this.SubScribeConf.Services {
@@ -147,12 +138,53 @@ func (this *ConfRoot) FillWithXml(data []byte) error {
 					this.SubScribeConf.Services[idx].Namespace = DEFAULT_NAMESPACE
 				}
 			}
+			if this.SubScribeConf.Services[idx].Balancer != nil {
+				err = this.SubScribeConf.Services[idx].Balancer.fill()
+				if err != nil {
+					return fmt.Errorf("subscribe %s: %w", this.SubScribeConf.Services[idx].Name, err)
+				}
+			}
 		}
 	}
 
 	return err
 }
 
+// 反序列化后的处理, 填充默认值
+func (this *RegisterConf) fill() error {
+	this.Namespace = strings.TrimSpace(this.Namespace)
+	if len(this.Namespace) == 0 {
+		this.Namespace = defaultRegisterOption.Namespace
+	}
+	if this.TTL == 0 {
+		this.TTL = int(defaultRegisterOption.TTLSec)
+	}
+	if this.Interval == 0 {
+		this.Interval = int(defaultRegisterOption.Interval / time.Second)
+	}
+	this.LeaseGroup = strings.TrimSpace(this.LeaseGroup)
+	this.Global.Zone = strings.TrimSpace(this.Global.Zone)
+	this.Global.Region = strings.TrimSpace(this.Global.Region)
+
+	//PrivateIP
+	ip, err := convertRegisterIP(this.Global.PrivateIPString)
+	if err != nil {
+		return err
+	}
+	this.Global.PrivateIP = ip
+
+	//PublicIP
+	ip, err = convertRegisterIP(this.Global.PublicIPString)
+	if err == nil {
+		this.Global.PublicIP = ip
+	}
+
+	if len(this.Global.NodeId) == 0 {
+		this.Global.NodeId = uuid.NewV1().String()
+	}
+	return nil
+}
+
 func convertRegisterIP(ipString string) (string, error) {
 	arr := strings.Split(ipString, ":")
 	var filterArr []string
@@ -176,22 +208,38 @@ func (this *ConfRoot) GetRegisterOptionFuncs() []RegisterOptionFunc {
 	if this.RegisterConf == nil {
 		return nil
 	}
-
-	register := this.RegisterConf
-	registerOp := make([]RegisterOptionFunc, 0, 4)
-	registerOp = append(registerOp, WithTTL(int64(register.TTL)))
-	registerOp = append(registerOp, WithRegisterNamespace(register.Namespace))
-	registerOp = append(registerOp, WithRegisterInterval(time.Duration(register.Interval)*time.Second))
-	registerOp = append(registerOp, WithRegisterConnTimeout(time.Duration(this.Timeout)*time.Second))
-	return registerOp
+	return this.RegisterConf.optionFuncs(this.Timeout)
 }
 
 func (this *ConfRoot) GetRegisterModule() (*RegisterInfo, error) {
 	if this.RegisterConf == nil {
 		return nil, fmt.Errorf("register conf is nil")
 	}
+	return this.RegisterConf.registerInfo()
+}
 
-	register := this.RegisterConf
+// 主注册项在前, 之后是Registers里的额外注册项
+func (this *ConfRoot) allRegisterConfs() []*RegisterConf {
+	arr := make([]*RegisterConf, 0, 1+len(this.ExtraRegisterConfs))
+	if this.RegisterConf != nil {
+		arr = append(arr, this.RegisterConf)
+	}
+	arr = append(arr, this.ExtraRegisterConfs...)
+	return arr
+}
+
+func (this *RegisterConf) optionFuncs(timeout int) []RegisterOptionFunc {
+	registerOp := make([]RegisterOptionFunc, 0, 5)
+	registerOp = append(registerOp, WithTTL(int64(this.TTL)))
+	registerOp = append(registerOp, WithRegisterNamespace(this.Namespace))
+	registerOp = append(registerOp, WithRegisterInterval(time.Duration(this.Interval)*time.Second))
+	registerOp = append(registerOp, WithRegisterConnTimeout(time.Duration(timeout)*time.Second))
+	registerOp = append(registerOp, WithRegisterLeaseGroup(this.LeaseGroup))
+	return registerOp
+}
+
+func (this *RegisterConf) registerInfo() (*RegisterInfo, error) {
+	register := this
 	if len(register.Global.Name) == 0 {
 		return nil, fmt.Errorf("register global.name is empty")
 	}
@@ -212,6 +260,8 @@ func (this *ConfRoot) GetRegisterModule() (*RegisterInfo, error) {
 	srvInfo.Global.PrivateIp = register.Global.PrivateIP
 	srvInfo.Global.PublicIP = register.Global.PublicIP
 	srvInfo.Global.State = register.Global.State
+	srvInfo.Global.Zone = register.Global.Zone
+	srvInfo.Global.Region = register.Global.Region
 
 	srvInfo.SvcInfos = register.SvcInfos
 	//if len(register.SvcInfos) > 0 {
@@ -239,3 +289,32 @@ func (this *ConfRoot) GetSubscribeBasicInfos() ([]SubBasicInfo, error) {
 
 	return infos, nil
 }
+
+// 按配置的Balancer创建Picker, 没有配置Balancer的服务不在结果里
+func (this *ConfRoot) getSubscribePickers() (map[string]Picker, error) {
+	pickers := make(map[string]Picker)
+	if this.SubScribeConf == nil {
+		return pickers, nil
+	}
+	for _, srv := range this.SubScribeConf.Services {
+		if srv.Balancer == nil {
+			continue
+		}
+		picker, err := srv.Balancer.NewPicker()
+		if err != nil {
+			return nil, err
+		}
+		pickers[srv.Name] = picker
+	}
+	return pickers, nil
+}
+
+// GetSubscribeOptionFuncs PreferLocalZone时使用Register的Zone/Region作为本地位置
+func (this *ConfRoot) GetSubscribeOptionFuncs() []SubscribeOptionFunc {
+	if this.SubScribeConf == nil || !this.SubScribeConf.PreferLocalZone || this.RegisterConf == nil {
+		return nil
+	}
+
+	global := this.RegisterConf.Global
+	return []SubscribeOptionFunc{WithSubscribeLocality(global.Zone, global.Region, this.SubScribeConf.MinZoneNodes)}
+}
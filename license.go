@@ -6,9 +6,6 @@ import (
 	"fmt"
 	jsoniter "github.com/json-iterator/go"
 	"github.com/xukgo/gsaber/encrypt/sm2"
-	"go.etcd.io/etcd/api/v3/mvccpb"
-	clientv3 "go.etcd.io/etcd/client/v3"
-	"log"
 	"math/big"
 	"time"
 )
@@ -88,69 +85,107 @@ func (this *Repo) GetLicResultInfo() *LicResultInfo {
 }
 
 func (this *Repo) StartSubLicResult(privKey string, watchFunc func(*LicResultInfo)) error {
+	return this.StartSubLicResultContext(context.Background(), privKey, watchFunc)
+}
+
+// StartSubLicResultContext 阻塞监听许可结果, 直到ctx结束(返回ctx.Err())或者repo被Close(返回nil)
+func (this *Repo) StartSubLicResultContext(parent context.Context, privKey string, watchFunc func(*LicResultInfo)) error {
 	if len(privKey) == 0 {
 		return fmt.Errorf("privKey is invalid")
 	}
 
+	if !this.beginRoutine() {
+		return fmt.Errorf("repo is closed")
+	}
+	defer this.routineWg.Done()
+
 	this.licPrivkey = privKey
 	this.licWatchFunc = watchFunc
 
+	ctx, cancel, err := this.bindContext(parent)
+	if err != nil {
+		return err
+	}
+	defer cancel()
+
 	prefix := LIC_RESULT_KEY
-	for {
-		watchChan := this.client.Watch(clientv3.WithRequireLeader(context.TODO()), prefix, clientv3.WithPrefix())
-		if watchChan == nil {
-			time.Sleep(time.Second)
+	for ctx.Err() == nil {
+		//先全量查询, 再从查询的下一个revision开始watch
+		revision, err := this.getLicResult(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				this.log().Warn("get license result failed", LOG_KEY_KEY, prefix, LOG_KEY_ERROR, err)
+			}
+			sleepContext(ctx, time.Second)
 			continue
 		}
-		this.getLicResult()
-
 		if this.licWatchFunc != nil {
 			this.licWatchFunc(this.GetLicResultInfo())
 		}
 
+		watchCtx, watchCancel := context.WithCancel(ctx)
+		watchChan := this.backend.WatchPrefix(watchCtx, prefix, revision+1)
+		if watchChan == nil {
+			watchCancel()
+			sleepContext(ctx, time.Second)
+			continue
+		}
+
 		for watchResponse := range watchChan {
 			this.updateLicResultByEvents(watchResponse.Events)
 			if this.licWatchFunc != nil {
 				this.licWatchFunc(this.GetLicResultInfo())
 			}
 		}
+		watchCancel()
+		sleepContext(ctx, time.Second)
 	}
+	return parent.Err()
 }
 
-func (this *Repo) getLicResult() error {
-	this.licLocker.Lock()
-	defer this.licLocker.Unlock()
+// 全量查询许可结果, 返回查询时的revision
+func (this *Repo) getLicResult(ctx context.Context) (revision int64, err error) {
+	ctx, span := this.startSpan(ctx, "srvDiscover.GetLicense", ATTR_KEY.String(LIC_RESULT_KEY))
+	defer func() {
+		endSpan(span, err)
+	}()
 
 	prefix := LIC_RESULT_KEY
-	getResponse, err := this.client.Get(context.TODO(), prefix, clientv3.WithPrefix())
+	var kvs []KeyValue
+	kvs, revision, err = this.backend.GetPrefix(ctx, prefix)
+	span.SetAttributes(ATTR_REVISION.Int64(revision))
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	//查询期间不持有licLocker, etcd无响应时GetLicResult和DebugInfo不会被阻塞
+	this.licLocker.Lock()
+	defer this.licLocker.Unlock()
 	//更新插入
-	for _, kv := range getResponse.Kvs {
-		this.upsertLicResult(kv)
+	for idx := range kvs {
+		this.upsertLicResult(&kvs[idx])
 	}
-	return nil
+	return revision, nil
 }
 
-func (this *Repo) updateLicResultByEvents(events []*clientv3.Event) {
+func (this *Repo) updateLicResultByEvents(events []Event) {
 	this.licLocker.Lock()
 	defer this.licLocker.Unlock()
 
-	for _, event := range events {
+	for idx := range events {
+		event := &events[idx]
 		switch event.Type {
-		case mvccpb.PUT:
-			this.upsertLicResult(event.Kv)
+		case EventPut:
+			this.upsertLicResult(&event.Kv)
 			break
-		case mvccpb.DELETE:
-			this.removeLicResult(event.Kv)
+		case EventDelete:
+			this.removeLicResult(&event.Kv)
 			break
 		}
 	}
 }
 
-func (this *Repo) removeLicResult(kv *mvccpb.KeyValue) {
+func (this *Repo) removeLicResult(kv *KeyValue) {
 	eventKey := string(kv.Key)
 	if eventKey != LIC_RESULT_KEY {
 		return
@@ -167,7 +202,7 @@ func (this *Repo) removeLicResult(kv *mvccpb.KeyValue) {
 	}
 }
 
-func (this *Repo) upsertLicResult(kv *mvccpb.KeyValue) {
+func (this *Repo) upsertLicResult(kv *KeyValue) {
 	eventKey := string(kv.Key)
 	eventRevision := kv.ModRevision
 	if eventKey != LIC_RESULT_KEY {
@@ -175,10 +210,8 @@ func (this *Repo) upsertLicResult(kv *mvccpb.KeyValue) {
 	}
 
 	if this.subLicResultInfo == nil {
-		resultInfo, err := parseLicResult(kv.Value, this.licPrivkey)
-		if err != nil {
-			log.Println("parse lic result error:", err.Error())
-		} else {
+		resultInfo, err := this.parseLicResult(kv)
+		if err == nil {
 			this.subLicResultInfo = new(SubLicResultInfo)
 			this.subLicResultInfo.Reversion = eventRevision
 			this.subLicResultInfo.Info = resultInfo
@@ -190,31 +223,37 @@ func (this *Repo) upsertLicResult(kv *mvccpb.KeyValue) {
 		return
 	}
 
-	resultInfo, err := parseLicResult(kv.Value, this.licPrivkey)
-	if err != nil {
-		log.Println("parse lic result error:", err.Error())
-	} else {
+	resultInfo, err := this.parseLicResult(kv)
+	if err == nil {
 		this.subLicResultInfo.Reversion = eventRevision
 		this.subLicResultInfo.Info = resultInfo
 	}
 }
 
+// 解析许可结果并记录日志
+func (this *Repo) parseLicResult(kv *KeyValue) (*LicResultInfo, error) {
+	resultInfo, err := parseLicResult(kv.Value, this.licPrivkey)
+	if err != nil {
+		this.log().Warn("parse license result failed", LOG_KEY_KEY, string(kv.Key), LOG_KEY_REVISION, kv.ModRevision, LOG_KEY_ERROR, err)
+	} else if resultInfo.Result == nil {
+		this.log().Warn("license result has no result field", LOG_KEY_KEY, string(kv.Key), LOG_KEY_REVISION, kv.ModRevision)
+	}
+	return resultInfo, err
+}
+
 func parseLicResult(data []byte, privKey string) (*LicResultInfo, error) {
 	data, err := hex.DecodeString(string(data))
 	if err != nil {
-		log.Println("sub licResult value decode hexString error:", err.Error())
-		return nil, err
+		return nil, fmt.Errorf("decode hex string error:%w", err)
 	}
 
 	model := new(LicResultInfo)
 	err = model.DecryptJson(data, privKey)
 	if err != nil {
-		log.Println("sub value licResult DecryptJson  error:", err.Error())
-		return nil, err
+		return nil, fmt.Errorf("decrypt json error:%w", err)
 	}
 
 	if model.Result == nil {
-		log.Println("sub value licResult unmarshal json result  error")
 		return model, nil
 	}
 	if model.Result.Code != 0 {
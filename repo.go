@@ -31,10 +31,34 @@ import (
 type Repo struct {
 	locker         sync.RWMutex
 	config         *ConfRoot
-	client         *clientv3.Client //etcd客户端
+	client         *clientv3.Client //etcd客户端, 使用WithBackend替换存储时为nil
+	backend        Backend
 	registerEnable *atomic.Bool
+	state          nodeState //节点状态, 通过ChangeState修改
+
+	//注册项, 按lease分组
+	regLocker     sync.Mutex
+	regSeq        int64
+	leaseGroups   map[string]*leaseGroup
+	registrations []*Registration
+
+	//生命周期, Close后ctx被取消, 所有后台协程退出
+	ctx        context.Context
+	cancel     context.CancelFunc
+	lifeLocker sync.Mutex
+	closed     bool
+	routineWg  sync.WaitGroup
 
 	subsNodeCache map[string]*SubSrvNodeList
+	outlierOption *OutlierOption                  //为nil时使用defaultOutlierOption
+	ejectTimers   map[*time.Timer]ejectionRefresh //剔除到期的定时器, Close时停止
+	clock         func() time.Time                //为nil时使用time.Now, 测试时替换以控制剔除到期
+	stats         repoStats
+	logger        repoLogger
+	tracer        repoTracer
+
+	changeLocker    sync.RWMutex
+	changeListeners []*serviceChangeListener
 
 	subLicResultInfo *SubLicResultInfo
 	licLocker        sync.RWMutex
@@ -63,6 +87,11 @@ func (this *Repo) SetNodeID(id string) {
 	this.config.RegisterConf.Global.NodeId = id
 }
 
+// WithBackend 使用指定的存储代替etcd, 需要在InitFromReader之前调用, Close时会关闭backend
+func (this *Repo) WithBackend(backend Backend) {
+	this.backend = backend
+}
+
 func (this *Repo) WithPredefEndpoint(s *PredefEndpoint) {
 	this.predefEndpoint = s
 }
@@ -118,11 +147,18 @@ func (this *Repo) InitFromReader(srcReader io.Reader) error {
 	}
 
 	this.registerEnable = atomic.NewBool(true)
+	this.lifeLocker.Lock()
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+	this.lifeLocker.Unlock()
 	this.config = srvConf
 	this.replacePredefEndpoints()
 	this.replacePredefRegisterVersion()
 	this.replacePredefSubsVersion()
 
+	if this.backend != nil {
+		return nil
+	}
+
 	tlsConfig, err := this.initTlsConfig()
 	if err != nil {
 		return err
@@ -140,9 +176,77 @@ func (this *Repo) InitFromReader(srcReader io.Reader) error {
 	if err != nil {
 		return err
 	}
+	this.backend = NewEtcdBackend(this.client)
 	return nil
 }
 
+// Close 停止注册、订阅和许可监听, 撤销当前租约使注册的key立即消失, 最后关闭etcd客户端
+// ctx用于限制等待后台协程退出的时间, 超时后仍会关闭客户端并返回ctx.Err()
+func (this *Repo) Close(ctx context.Context) error {
+	this.lifeLocker.Lock()
+	if this.closed {
+		this.lifeLocker.Unlock()
+		return nil
+	}
+	this.closed = true
+	this.lifeLocker.Unlock()
+
+	if this.cancel != nil {
+		this.cancel()
+	}
+	this.stopEjectionTimers()
+
+	done := make(chan struct{})
+	go func() {
+		this.routineWg.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if this.backend != nil {
+		cerr := this.backend.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// 派生一个同时受调用方ctx和repo生命周期控制的ctx, repo尚未初始化时返回错误
+func (this *Repo) bindContext(ctx context.Context) (context.Context, context.CancelFunc, error) {
+	this.lifeLocker.Lock()
+	repoCtx := this.ctx
+	this.lifeLocker.Unlock()
+	if repoCtx == nil {
+		return nil, nil, fmt.Errorf("repo is not initialized")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(repoCtx, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}, nil
+}
+
+// 登记一个后台协程, 已经Close或者尚未初始化时返回false
+func (this *Repo) beginRoutine() bool {
+	this.lifeLocker.Lock()
+	defer this.lifeLocker.Unlock()
+
+	if this.closed || this.ctx == nil {
+		return false
+	}
+	this.routineWg.Add(1)
+	return true
+}
+
 func (this *Repo) initTlsConfig() (*tls.Config, error) {
 	tlsConf := this.config.ClientTls
 	if tlsConf == nil {
@@ -216,39 +320,101 @@ func (this *Repo) initTlsConfig() (*tls.Config, error) {
 }
 
 func (this *Repo) StartRegister(beforeRegisterFunc BeforeRegisterFunc, resultCallback RegisterResultCallback) error {
+	return this.StartRegisterContext(context.Background(), beforeRegisterFunc, resultCallback)
+}
+
+// StartRegisterContext 按配置注册主注册项和Registers里的额外注册项, ctx结束后删除注册的key
+// 主注册项使用Repo的节点状态, 额外注册项的状态通过Registrations返回的句柄修改
+func (this *Repo) StartRegisterContext(ctx context.Context, beforeRegisterFunc BeforeRegisterFunc, resultCallback RegisterResultCallback) error {
 	if this.config == nil {
 		return fmt.Errorf("register conf is nil")
 	}
 
-	registerOp := this.config.GetRegisterOptionFuncs()
-	if beforeRegisterFunc != nil {
-		registerOp = append(registerOp, WithBeforeRegister(beforeRegisterFunc))
+	confs := this.config.allRegisterConfs()
+	if len(confs) == 0 {
+		return fmt.Errorf("register conf is nil")
 	}
-	if resultCallback != nil {
-		registerOp = append(registerOp, WithRegisterResultCallback(resultCallback))
-	} else {
-		registerOp = append(registerOp, WithRegisterResultCallback(func(err error) {}))
+
+	srvInfos := make([]*RegisterInfo, 0, len(confs))
+	for idx := range confs {
+		srvInfo, err := confs[idx].registerInfo()
+		if err != nil {
+			return err
+		}
+		srvInfos = append(srvInfos, srvInfo)
 	}
 
-	srvInfo, err := this.config.GetRegisterModule()
-	if err != nil {
-		return err
+	regs := make([]*Registration, 0, len(confs))
+	for idx := range confs {
+		registerOp := confs[idx].optionFuncs(this.config.Timeout)
+		if beforeRegisterFunc != nil {
+			registerOp = append(registerOp, WithBeforeRegister(beforeRegisterFunc))
+		}
+		if resultCallback != nil {
+			registerOp = append(registerOp, WithRegisterResultCallback(resultCallback))
+		} else {
+			registerOp = append(registerOp, WithRegisterResultCallback(func(err error) {}))
+		}
+
+		state := new(nodeState)
+		if confs[idx] == this.config.RegisterConf {
+			state = &this.state
+		}
+		reg, err := this.addRegistration(srvInfos[idx], state, registerOp...)
+		if err != nil {
+			//已经开始的注册项不再受ctx控制, 需要立即移除
+			this.removeRegistrations(regs)
+			return err
+		}
+		regs = append(regs, reg)
 	}
 
-	go this.Register(srvInfo, registerOp...)
+	this.removeRegistrationsOnDone(ctx, regs)
 	return nil
 }
 
+// ctx结束后移除注册项
+func (this *Repo) removeRegistrationsOnDone(ctx context.Context, regs []*Registration) {
+	if ctx.Done() == nil || !this.beginRoutine() {
+		return
+	}
+
+	go func() {
+		defer this.routineWg.Done()
+
+		ctx, cancel, err := this.bindContext(ctx)
+		if err != nil {
+			return
+		}
+		defer cancel()
+
+		<-ctx.Done()
+		this.removeRegistrations(regs)
+	}()
+}
+
+func (this *Repo) removeRegistrations(regs []*Registration) {
+	for _, reg := range regs {
+		removeCtx, cancel := context.WithTimeout(context.Background(), reg.option.ConnTimeout)
+		_ = reg.Remove(removeCtx)
+		cancel()
+	}
+}
+
 func (this *Repo) GetPrefixKvs(prefix string) ([]Ekv, error) {
+	return this.GetPrefixKvsContext(context.TODO(), prefix)
+}
+
+func (this *Repo) GetPrefixKvsContext(ctx context.Context, prefix string) ([]Ekv, error) {
 	if len(prefix) == 0 {
 		prefix = "/registry."
 	}
-	response, err := this.client.Get(context.TODO(), prefix, clientv3.WithPrefix())
+	kvs, _, err := this.backend.GetPrefix(ctx, prefix)
 	if err != nil {
 		return nil, err
 	}
-	list := make([]Ekv, 0, len(response.Kvs))
-	for _, kv := range response.Kvs {
+	list := make([]Ekv, 0, len(kvs))
+	for _, kv := range kvs {
 		list = append(list, InitEkv(kv.Key, kv.Value))
 	}
 	vs := Ekvs(list)
@@ -257,6 +423,11 @@ func (this *Repo) GetPrefixKvs(prefix string) ([]Ekv, error) {
 }
 
 func (this *Repo) StartSubscribe() error {
+	return this.StartSubscribeContext(context.Background())
+}
+
+// StartSubscribeContext ctx结束后停止所有订阅的watch并删除缓存, 之后可以再次StartSubscribe
+func (this *Repo) StartSubscribeContext(ctx context.Context) error {
 	if this.config == nil {
 		return fmt.Errorf("register conf is nil")
 	}
@@ -266,9 +437,22 @@ func (this *Repo) StartSubscribe() error {
 		return err
 	}
 
-	this.initSubsNodeCache(subBasicInfos)
-	err = this.SubScribe(subBasicInfos)
-	return err
+	pickers, err := this.config.getSubscribePickers()
+	if err != nil {
+		return err
+	}
+
+	err = this.SubScribeContext(ctx, subBasicInfos, this.config.GetSubscribeOptionFuncs()...)
+	if err != nil {
+		return err
+	}
+	for name, picker := range pickers {
+		err = this.SetPicker(name, picker)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (this *Repo) GetLocalRegisterInfo() *RegisterConf {
@@ -276,33 +460,34 @@ func (this *Repo) GetLocalRegisterInfo() *RegisterConf {
 	return conf.RegisterConf
 }
 
+// GetSubsNames 当前订阅的服务名, 包括运行时Subscribe的服务, 不包括已经Unsubscribe的服务, 按名字排序
 func (this *Repo) GetSubsNames() []string {
-	subsconf := this.config.SubScribeConf
-	if subsconf == nil {
-		return nil
-	}
-	if len(subsconf.Services) == 0 {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	if len(this.subsNodeCache) == 0 {
 		return nil
 	}
-
-	arr := make([]string, 0, len(subsconf.Services))
-	for idx := range subsconf.Services {
-		arr = append(arr, subsconf.Services[idx].Name)
+	arr := make([]string, 0, len(this.subsNodeCache))
+	for srvName := range this.subsNodeCache {
+		arr = append(arr, srvName)
 	}
+	sort.Strings(arr)
 	return arr
 }
 
-// 只会查询online的
+// 只会查询online并且没有被ReportResult剔除的
 func (this *Repo) GetServiceByName(name string) []RegisterInfo {
 	this.locker.RLock()
 	defer this.locker.RUnlock()
 
+	now := this.now()
 	var srvInfos []RegisterInfo = nil
 	for srvName, srvNodeList := range this.subsNodeCache {
 		if stringUtil.CompareIgnoreCase(srvName, name) {
 			srvInfos = make([]RegisterInfo, 0, len(srvNodeList.NodeInfos))
 			for n := range srvNodeList.NodeInfos {
-				if stringUtil.CompareIgnoreCase(srvNodeList.NodeInfos[n].RegInfo.Global.State, STATE_ONLINE) {
+				if isNodeAvailable(srvNodeList.NodeInfos[n], now) {
 					srvInfos = append(srvInfos, srvNodeList.NodeInfos[n].RegInfo.DeepClone(true))
 				}
 			}
@@ -312,15 +497,20 @@ func (this *Repo) GetServiceByName(name string) []RegisterInfo {
 	return srvInfos
 }
 
+// 被ReportResult剔除的节点不会传给filterFunc
 func (this *Repo) GetFilterServices(name string, filterFunc func(*SrvNodeInfo) bool) []RegisterInfo {
 	this.locker.RLock()
 	defer this.locker.RUnlock()
 
+	now := this.now()
 	var srvInfos []RegisterInfo = nil
 	for srvName, srvNodeList := range this.subsNodeCache {
 		if stringUtil.CompareIgnoreCase(srvName, name) {
 			srvInfos = make([]RegisterInfo, 0, len(srvNodeList.NodeInfos))
 			for n := range srvNodeList.NodeInfos {
+				if srvNodeList.NodeInfos[n].health.ejected(now) {
+					continue
+				}
 				if filterFunc(srvNodeList.NodeInfos[n]) {
 					srvInfos = append(srvInfos, srvNodeList.NodeInfos[n].RegInfo.DeepClone(true))
 				}
@@ -338,10 +528,14 @@ func (this *Repo) GetFilterServiceCount(name string, filterFunc func(*SrvNodeInf
 	this.locker.RLock()
 	defer this.locker.RUnlock()
 
+	now := this.now()
 	var count = 0
 	for srvName, srvNodeList := range this.subsNodeCache {
 		if stringUtil.CompareIgnoreCase(srvName, name) {
 			for n := range srvNodeList.NodeInfos {
+				if srvNodeList.NodeInfos[n].health.ejected(now) {
+					continue
+				}
 				if filterFunc(srvNodeList.NodeInfos[n]) {
 					count++
 				}
@@ -361,14 +555,19 @@ func (this *Repo) GetRandomServiceArray(svcName string) []RegisterInfo {
 	return infos
 }
 
+// 从可选节点中随机选择, 订阅设置了Locality时优先本地节点
 func (this *Repo) GetRandomServiceByName(svcName string) (bool, RegisterInfo) {
-	infos := this.GetServiceByName(svcName)
-	if len(infos) == 0 {
+	this.locker.RLock()
+	defer this.locker.RUnlock()
+
+	srvNodeList := this.getSubsNodeList(svcName)
+	if srvNodeList == nil || len(srvNodeList.pickNodes) == 0 {
 		return false, RegisterInfo{}
 	}
 
-	idx := randomUtil.NewInt32(0, int32(len(infos)))
-	return true, infos[idx].DeepClone(false)
+	nodes := srvNodeList.pickNodes
+	idx := randomUtil.NewInt32(0, int32(len(nodes)))
+	return true, nodes[idx].RegInfo.DeepClone(false)
 }
 
 func (this *Repo) GetServiceByNameAndNodeId(svcName string, id string) (bool, RegisterInfo) {
@@ -385,6 +584,9 @@ func (this *Repo) GetServiceByNameAndNodeId(svcName string, id string) (bool, Re
 			if nodes[n].RegInfo.Global.NodeId != id {
 				continue
 			}
+			if nodes[n].health.ejected(this.now()) {
+				return false, RegisterInfo{}
+			}
 
 			state := nodes[n].RegInfo.Global.State
 			if stringUtil.CompareIgnoreCase(state, STATE_ONLINE) || stringUtil.CompareIgnoreCase(state, STATE_BYPASS) {
@@ -396,18 +598,24 @@ func (this *Repo) GetServiceByNameAndNodeId(svcName string, id string) (bool, Re
 	return false, RegisterInfo{}
 }
 
+// 合并到已有的缓存, 运行时通过Subscribe增加的订阅不受影响
 func (this *Repo) initSubsNodeCache(subSrvInfos []SubBasicInfo) {
 	serviceCount := len(subSrvInfos)
 	if serviceCount <= 0 {
 		return
 	}
 
-	this.subsNodeCache = make(map[string]*SubSrvNodeList)
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if this.subsNodeCache == nil {
+		this.subsNodeCache = make(map[string]*SubSrvNodeList)
+	}
 	for m := 0; m < serviceCount; m++ {
-		srvNodeList := new(SubSrvNodeList)
-		srvNodeList.SubBasicInfo = *NewSubSrvBasicInfo(subSrvInfos[m].Name, subSrvInfos[m].Version, subSrvInfos[m].Namespace)
-		srvNodeList.NodeInfos = make([]*SrvNodeInfo, 0, 1)
-		this.subsNodeCache[subSrvInfos[m].Name] = srvNodeList
+		if _, ok := this.subsNodeCache[subSrvInfos[m].Name]; ok {
+			continue
+		}
+		this.subsNodeCache[subSrvInfos[m].Name] = newSubSrvNodeList(subSrvInfos[m])
 	}
 }
 
@@ -437,6 +645,19 @@ func (this *Repo) replacePredefSubsVersion() {
 	}
 }
 
+// 睡眠指定时间, ctx提前结束则返回false
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
 // 随机打乱数组
 func randomSortSlice(arr []RegisterInfo) {
 	if len(arr) <= 0 || len(arr) == 1 {
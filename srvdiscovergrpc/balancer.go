@@ -0,0 +1,263 @@
+package srvdiscovergrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/xukgo/srvDiscover"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"strings"
+)
+
+// BalancerName 负载均衡策略的名字, 包初始化时注册到gRPC
+const BalancerName = "srvdiscover"
+
+func init() {
+	balancer.Register(new(balancerBuilder))
+}
+
+// BalancerConfig 负载均衡配置, 以JSON放在服务配置的loadBalancingConfig里
+// 只选择State为online的节点, 按Weights计算的权重随机选择, 设置了Zone/Region时优先本地节点
+type BalancerConfig struct {
+	serviceconfig.LoadBalancingConfig `json:"-"`
+
+	Zone         string                      `json:"zone,omitempty"`
+	Region       string                      `json:"region,omitempty"`
+	MinZoneNodes int                         `json:"minZoneNodes,omitempty"` //本地节点少于该值时使用其它节点, 默认为1
+	Weights      *srvDiscover.ProfileWeights `json:"weights,omitempty"`      //为空时使用DefaultProfileWeights
+}
+
+// WithBalancer 使用srvdiscover负载均衡策略, 同时包含所有状态的节点
+// 节点状态和负载变化时只更新选择结果, 不会重建连接
+func WithBalancer(config BalancerConfig) BuilderOptionFunc {
+	configJson, _ := json.Marshal(config)
+	serviceConfig := fmt.Sprintf(`{"loadBalancingConfig":[{"%s":%s}]}`, BalancerName, configJson)
+	return func(option *BuilderOption) {
+		option.AllStates = true
+		option.ServiceConfig = serviceConfig
+	}
+}
+
+type balancerBuilder struct {
+}
+
+func (this *balancerBuilder) Name() string {
+	return BalancerName
+}
+
+func (this *balancerBuilder) ParseConfig(data json.RawMessage) (serviceconfig.LoadBalancingConfig, error) {
+	config := new(BalancerConfig)
+	if len(data) > 0 {
+		err := json.Unmarshal(data, config)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s balancer config error:%w", BalancerName, err)
+		}
+	}
+	return config, nil
+}
+
+func (this *balancerBuilder) Build(cc balancer.ClientConn, opts balancer.BuildOptions) balancer.Balancer {
+	return &registryBalancer{
+		cc:       cc,
+		config:   new(BalancerConfig),
+		subConns: make(map[string]*subConnInfo),
+		state:    connectivity.Connecting,
+	}
+}
+
+type subConnInfo struct {
+	subConn balancer.SubConn
+	addr    resolver.Address //最新的地址, BalancerAttributes随resolver更新
+	state   connectivity.State
+	err     error
+}
+
+// gRPC保证balancer的方法和SubConn的StateListener串行调用, 不需要加锁
+type registryBalancer struct {
+	cc          balancer.ClientConn
+	config      *BalancerConfig
+	subConns    map[string]*subConnInfo //key为host:port
+	state       connectivity.State
+	resolverErr error
+}
+
+func (this *registryBalancer) UpdateClientConnState(state balancer.ClientConnState) error {
+	if config, ok := state.BalancerConfig.(*BalancerConfig); ok {
+		this.config = config
+	}
+	this.resolverErr = nil
+
+	addrs := make(map[string]bool, len(state.ResolverState.Addresses))
+	for _, addr := range state.ResolverState.Addresses {
+		addrs[addr.Addr] = true
+		info, ok := this.subConns[addr.Addr]
+		if ok {
+			//只更新属性, 连接保持不变
+			info.addr = addr
+			continue
+		}
+
+		info = &subConnInfo{addr: addr, state: connectivity.Idle}
+		subConn, err := this.cc.NewSubConn([]resolver.Address{{Addr: addr.Addr, ServerName: addr.ServerName}}, balancer.NewSubConnOptions{
+			StateListener: func(subConnState balancer.SubConnState) {
+				this.updateSubConnState(info, subConnState)
+			},
+		})
+		if err != nil {
+			continue
+		}
+		info.subConn = subConn
+		this.subConns[addr.Addr] = info
+		subConn.Connect()
+	}
+
+	for key, info := range this.subConns {
+		if !addrs[key] {
+			info.subConn.Shutdown()
+			delete(this.subConns, key)
+		}
+	}
+
+	if len(state.ResolverState.Addresses) == 0 {
+		this.ResolverError(fmt.Errorf("resolver produced zero addresses"))
+		return balancer.ErrBadResolverState
+	}
+	this.updatePicker()
+	return nil
+}
+
+func (this *registryBalancer) ResolverError(err error) {
+	this.resolverErr = err
+	if len(this.subConns) == 0 {
+		this.state = connectivity.TransientFailure
+	}
+	this.updatePicker()
+}
+
+// UpdateSubConnState 状态通过StateListener通知, 这里不会被调用
+func (this *registryBalancer) UpdateSubConnState(balancer.SubConn, balancer.SubConnState) {}
+
+func (this *registryBalancer) updateSubConnState(info *subConnInfo, state balancer.SubConnState) {
+	if current, ok := this.subConns[info.addr.Addr]; !ok || current != info {
+		return
+	}
+	info.state = state.ConnectivityState
+	info.err = state.ConnectionError
+	//连接断开后重新连接, 节点不在online状态时也保持连接
+	if info.state == connectivity.Idle {
+		info.subConn.Connect()
+	}
+	this.updatePicker()
+}
+
+func (this *registryBalancer) ExitIdle() {
+	for _, info := range this.subConns {
+		if info.state == connectivity.Idle {
+			info.subConn.Connect()
+		}
+	}
+}
+
+func (this *registryBalancer) Close() {
+	for key, info := range this.subConns {
+		info.subConn.Shutdown()
+		delete(this.subConns, key)
+	}
+}
+
+// 只有online的节点参与状态汇总和选择
+func (this *registryBalancer) updatePicker() {
+	ready := make([]*subConnInfo, 0, len(this.subConns))
+	connecting := false
+	var lastErr error
+	for _, info := range this.subConns {
+		attrs, ok := GetNodeAttributes(info.addr)
+		if !ok || !strings.EqualFold(attrs.State, srvDiscover.STATE_ONLINE) {
+			continue
+		}
+		switch info.state {
+		case connectivity.Ready:
+			ready = append(ready, info)
+		case connectivity.Idle, connectivity.Connecting:
+			connecting = true
+		case connectivity.TransientFailure:
+			lastErr = info.err
+		}
+	}
+
+	var picker balancer.Picker
+	switch {
+	case len(ready) > 0:
+		this.state = connectivity.Ready
+		picker = newRegistryPicker(this.config, ready)
+	case connecting:
+		this.state = connectivity.Connecting
+		picker = errPicker{err: balancer.ErrNoSubConnAvailable}
+	default:
+		this.state = connectivity.TransientFailure
+		err := fmt.Errorf("no online node available")
+		if lastErr != nil {
+			err = fmt.Errorf("no online node available, last connection error:%w", lastErr)
+		} else if this.resolverErr != nil {
+			err = fmt.Errorf("no online node available, resolver error:%w", this.resolverErr)
+		}
+		picker = errPicker{err: status.Error(codes.Unavailable, err.Error())}
+	}
+	this.cc.UpdateState(balancer.State{ConnectivityState: this.state, Picker: picker})
+}
+
+type errPicker struct {
+	err error
+}
+
+func (this errPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	return balancer.PickResult{}, this.err
+}
+
+type weightedSubConn struct {
+	subConn balancer.SubConn
+	weight  float64
+}
+
+// 创建时计算好权重, Pick只做一次随机
+type registryPicker struct {
+	subConns []weightedSubConn
+	total    float64
+}
+
+func newRegistryPicker(config *BalancerConfig, ready []*subConnInfo) *registryPicker {
+	weights := srvDiscover.DefaultProfileWeights
+	if config.Weights != nil {
+		weights = *config.Weights
+	}
+
+	model := new(registryPicker)
+	locality := srvDiscover.SubscribeLocality{Zone: config.Zone, Region: config.Region, MinNodes: config.MinZoneNodes}
+	ready = srvDiscover.FilterLocality(locality, ready, func(info *subConnInfo) (string, string) {
+		attrs, _ := GetNodeAttributes(info.addr)
+		return attrs.Zone, attrs.Region
+	})
+	for _, info := range ready {
+		attrs, _ := GetNodeAttributes(info.addr)
+		weight := weights.Weight(attrs.Profile)
+		model.subConns = append(model.subConns, weightedSubConn{subConn: info.subConn, weight: weight})
+		model.total += weight
+	}
+	return model
+}
+
+func (this *registryPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	value := rand.Float64() * this.total
+	for _, item := range this.subConns {
+		value -= item.weight
+		if value < 0 {
+			return balancer.PickResult{SubConn: item.subConn}, nil
+		}
+	}
+	return balancer.PickResult{SubConn: this.subConns[len(this.subConns)-1].subConn}, nil
+}
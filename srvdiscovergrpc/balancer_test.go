@@ -0,0 +1,112 @@
+package srvdiscovergrpc
+
+import (
+	"context"
+	"github.com/xukgo/srvDiscover"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"net"
+	"testing"
+	"time"
+)
+
+// 每个节点的health服务只认识自己的nodeId, 用于判断请求被发到了哪个节点
+func startNodeHealthServer(t *testing.T, nodeId string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(nodeId, healthpb.HealthCheckResponse_SERVING)
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func checkAll(t *testing.T, client healthpb.HealthClient, nodeId string, count int) bool {
+	for i := 0; i < count; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: nodeId}, grpc.WaitForReady(true))
+		cancel()
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_BalancerStateAndZone(t *testing.T) {
+	server, repo := newSubscribedRepo(t)
+	infos := make(map[string]*srvDiscover.RegisterInfo)
+	for nodeId, zone := range map[string]string{"push-1": "z1", "push-2": "z2"} {
+		info := newPushGatewayInfo(nodeId, startNodeHealthServer(t, nodeId))
+		info.Global.Zone = zone
+		server.InjectRegistration(t, "", info, 30)
+		infos[nodeId] = info
+	}
+
+	conn, err := grpc.NewClient("srvdiscover:///PushGateway?port=grpc",
+		grpc.WithResolvers(NewBuilder(repo, WithBalancer(BalancerConfig{Zone: "z2"}))),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	//优先本地Zone
+	deadline := time.Now().Add(5 * time.Second)
+	for !checkAll(t, client, "push-2", 20) {
+		if time.Now().After(deadline) {
+			t.Fatal("local zone node not preferred")
+		}
+	}
+
+	//本地节点offline后使用其它Zone的节点
+	infos["push-2"].Global.State = srvDiscover.STATE_OFFLINE
+	server.InjectRegistration(t, "", infos["push-2"], 30)
+	deadline = time.Now().Add(5 * time.Second)
+	for !checkAll(t, client, "push-1", 20) {
+		if time.Now().After(deadline) {
+			t.Fatal("offline node still picked")
+		}
+	}
+
+	//恢复online后立即切回
+	infos["push-2"].Global.State = srvDiscover.STATE_ONLINE
+	server.InjectRegistration(t, "", infos["push-2"], 30)
+	deadline = time.Now().Add(5 * time.Second)
+	for !checkAll(t, client, "push-2", 20) {
+		if time.Now().After(deadline) {
+			t.Fatal("node not picked after back online")
+		}
+	}
+}
+
+func Test_BalancerNoOnlineNode(t *testing.T) {
+	server, repo := newSubscribedRepo(t)
+	info := newPushGatewayInfo("push-1", startNodeHealthServer(t, "push-1"))
+	info.Global.State = srvDiscover.STATE_NOTREADY
+	server.InjectRegistration(t, "", info, 30)
+
+	conn, err := grpc.NewClient("srvdiscover:///PushGateway?port=grpc",
+		grpc.WithResolvers(NewBuilder(repo, WithBalancer(BalancerConfig{}))),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: "push-1"}, grpc.WaitForReady(true))
+	if err == nil {
+		t.Fatal("notReady node picked")
+	}
+}
@@ -0,0 +1,225 @@
+// Package srvdiscovergrpc 把srvDiscover的订阅接入gRPC的服务发现
+//
+// 使用方式:
+//
+//	srvdiscovergrpc.Register(repo)
+//	conn, err := grpc.NewClient("srvdiscover:///PushGateway?port=grpc", ...)
+//
+// 服务需要先通过配置或者Repo.Subscribe订阅; 地址为节点的PrivateIp加上名为port的SvcInfo端口,
+// 只有一个SvcInfo时可以省略port
+//
+// 通过WithBalancer使用srvdiscover负载均衡策略时, 节点的ChangeState和负载变化直接作用于选择结果:
+//
+//	builder := srvdiscovergrpc.NewBuilder(repo, srvdiscovergrpc.WithBalancer(srvdiscovergrpc.BalancerConfig{Zone: "z1"}))
+//	conn, err := grpc.NewClient("srvdiscover:///PushGateway?port=grpc", grpc.WithResolvers(builder), ...)
+package srvdiscovergrpc
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/srvDiscover"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const Scheme = "srvdiscover"
+
+type nodeAttributesKey struct{}
+
+// NodeAttributes 节点的注册信息, 放在resolver.Address的BalancerAttributes里
+// 这些属性变化时gRPC不会重建连接
+type NodeAttributes struct {
+	NodeId  string
+	State   string
+	Version string
+	Zone    string
+	Region  string
+	Profile srvDiscover.RegisterProfileInfo
+}
+
+// GetNodeAttributes 读取resolver写入的节点属性
+func GetNodeAttributes(addr resolver.Address) (NodeAttributes, bool) {
+	value, ok := addr.BalancerAttributes.Value(nodeAttributesKey{}).(NodeAttributes)
+	return value, ok
+}
+
+type builder struct {
+	repo   *srvDiscover.Repo
+	option *BuilderOption
+}
+
+type BuilderOption struct {
+	AllStates     bool   //为true时包含所有状态的节点, 否则只包含online的节点
+	ServiceConfig string //非空时作为服务配置下发
+}
+
+type BuilderOptionFunc func(option *BuilderOption)
+
+// WithAllStates 包含所有状态的节点, 由balancer根据NodeAttributes.State过滤
+func WithAllStates() BuilderOptionFunc {
+	return func(option *BuilderOption) {
+		option.AllStates = true
+	}
+}
+
+func WithServiceConfig(serviceConfig string) BuilderOptionFunc {
+	return func(option *BuilderOption) {
+		option.ServiceConfig = serviceConfig
+	}
+}
+
+// NewBuilder 创建scheme为srvdiscover的resolver.Builder, 可以通过grpc.WithResolvers使用
+func NewBuilder(repo *srvDiscover.Repo, options ...BuilderOptionFunc) resolver.Builder {
+	model := new(builder)
+	model.repo = repo
+	model.option = new(BuilderOption)
+	for _, op := range options {
+		op(model.option)
+	}
+	return model
+}
+
+// Register 全局注册resolver, 需要在创建gRPC连接前调用, 不是并发安全的
+func Register(repo *srvDiscover.Repo, options ...BuilderOptionFunc) {
+	resolver.Register(NewBuilder(repo, options...))
+}
+
+func (this *builder) Scheme() string {
+	return Scheme
+}
+
+func (this *builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	service := strings.TrimPrefix(target.URL.Path, "/")
+	if len(service) == 0 {
+		service = target.URL.Opaque
+	}
+	if len(service) == 0 {
+		return nil, fmt.Errorf("srvdiscover target %s has no service name", target.URL.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := this.repo.WatchService(ctx, service)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	model := &serviceResolver{
+		cc:       cc,
+		option:   this.option,
+		service:  service,
+		portName: target.URL.Query().Get("port"),
+		cancel:   cancel,
+		nodes:    make(map[string]srvDiscover.RegisterInfo),
+	}
+	if len(this.option.ServiceConfig) > 0 {
+		model.serviceConfig = cc.ParseServiceConfig(this.option.ServiceConfig)
+	}
+
+	model.wg.Add(1)
+	go model.watch(events)
+	return model, nil
+}
+
+type serviceResolver struct {
+	cc            resolver.ClientConn
+	option        *BuilderOption
+	serviceConfig *serviceconfig.ParseResult
+	service       string
+	portName      string
+	cancel        context.CancelFunc
+	wg            sync.WaitGroup
+	nodes         map[string]srvDiscover.RegisterInfo //key为RegisterInfo.UniqueId()
+}
+
+// ResolveNow 地址由watch推送, 不需要主动解析
+func (this *serviceResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (this *serviceResolver) Close() {
+	this.cancel()
+	this.wg.Wait()
+}
+
+func (this *serviceResolver) watch(events <-chan srvDiscover.ServiceEvent) {
+	defer this.wg.Done()
+
+	for event := range events {
+		switch event.Type {
+		case srvDiscover.ServiceEventSnapshot:
+			this.nodes = make(map[string]srvDiscover.RegisterInfo, len(event.Nodes))
+			for _, info := range event.Nodes {
+				this.nodes[info.UniqueId()] = info
+			}
+		case srvDiscover.ServiceEventPut:
+			for _, info := range event.Nodes {
+				this.nodes[info.UniqueId()] = info
+			}
+		case srvDiscover.ServiceEventDelete:
+			for _, info := range event.Nodes {
+				delete(this.nodes, info.UniqueId())
+			}
+		}
+		this.update()
+	}
+}
+
+func (this *serviceResolver) update() {
+	addrs := make([]resolver.Address, 0, len(this.nodes))
+	for _, info := range this.nodes {
+		if !this.option.AllStates && !strings.EqualFold(info.Global.State, srvDiscover.STATE_ONLINE) {
+			continue
+		}
+		port, ok := findPort(info.SvcInfos, this.portName)
+		if !ok || len(info.Global.PrivateIp) == 0 {
+			continue
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr: net.JoinHostPort(info.Global.PrivateIp, strconv.Itoa(port)),
+			BalancerAttributes: attributes.New(nodeAttributesKey{}, NodeAttributes{
+				NodeId:  info.Global.NodeId,
+				State:   info.Global.State,
+				Version: info.Global.Version,
+				Zone:    info.Global.Zone,
+				Region:  info.Global.Region,
+				Profile: info.Profile,
+			}),
+		})
+	}
+	//map的遍历顺序随机, 排序避免pick_first等策略认为地址列表发生了变化
+	sort.Slice(addrs, func(i, j int) bool {
+		return addrs[i].Addr < addrs[j].Addr
+	})
+
+	state := resolver.State{Addresses: addrs}
+	if this.serviceConfig != nil {
+		state.ServiceConfig = this.serviceConfig
+	}
+	//数据由watch推送, balancer拒绝时等待下一次变化
+	//没有可用节点时也要更新, 否则gRPC会继续使用之前的地址
+	_ = this.cc.UpdateState(state)
+	if len(addrs) == 0 {
+		this.cc.ReportError(fmt.Errorf("service %s has no available node", this.service))
+	}
+}
+
+// portName为空时只有一个SvcInfo才能确定端口
+func findPort(svcInfos []srvDiscover.RegisterSvcDefineConf, portName string) (int, bool) {
+	if len(portName) == 0 {
+		if len(svcInfos) == 1 {
+			return svcInfos[0].Port, true
+		}
+		return 0, false
+	}
+	for _, svc := range svcInfos {
+		if strings.EqualFold(svc.Name, portName) {
+			return svc.Port, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,178 @@
+package srvdiscovergrpc
+
+import (
+	"context"
+	"github.com/xukgo/srvDiscover"
+	"github.com/xukgo/srvDiscover/srvdiscovertest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+const subscribeConf = `<SrvDiscover>
+    <Subscribe>
+        <Service>
+            <Name>PushGateway</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+func newPushGatewayInfo(nodeId string, port int) *srvDiscover.RegisterInfo {
+	info := new(srvDiscover.RegisterInfo)
+	info.Global.Name = "PushGateway"
+	info.Global.NodeId = nodeId
+	info.Global.Version = "PushGateway-1.0.0"
+	info.Global.PrivateIp = "127.0.0.1"
+	info.SvcInfos = []srvDiscover.RegisterSvcDefineConf{
+		{Name: "restful", Port: port + 1},
+		{Name: "grpc", Port: port},
+	}
+	return info
+}
+
+func newSubscribedRepo(t *testing.T) (*srvdiscovertest.Server, *srvDiscover.Repo) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, repo
+}
+
+func startHealthServer(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+	go func() {
+		_ = grpcServer.Serve(listener)
+	}()
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func Test_ResolverDial(t *testing.T) {
+	server, repo := newSubscribedRepo(t)
+	port := startHealthServer(t)
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1", port), 30)
+
+	conn, err := grpc.NewClient("srvdiscover:///PushGateway?port=grpc",
+		grpc.WithResolvers(NewBuilder(repo)),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+
+	//节点删除后不再发往该节点
+	server.RemoveRegistration(t, "", newPushGatewayInfo("push-1", port))
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		_, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+		return err != nil
+	})
+}
+
+type fakeClientConn struct {
+	resolver.ClientConn
+
+	locker sync.Mutex
+	states []resolver.State
+}
+
+func (this *fakeClientConn) UpdateState(state resolver.State) error {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	this.states = append(this.states, state)
+	return nil
+}
+
+func (this *fakeClientConn) ReportError(err error) {}
+
+func (this *fakeClientConn) lastAddrs() []resolver.Address {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	if len(this.states) == 0 {
+		return nil
+	}
+	return this.states[len(this.states)-1].Addresses
+}
+
+func buildResolver(t *testing.T, repo *srvDiscover.Repo, target string, options ...BuilderOptionFunc) *fakeClientConn {
+	cc := new(fakeClientConn)
+	targetUrl, err := url.Parse(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewBuilder(repo, options...).Build(resolver.Target{URL: *targetUrl}, cc, resolver.BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return cc
+}
+
+func Test_ResolverUpdates(t *testing.T) {
+	server, repo := newSubscribedRepo(t)
+	info := newPushGatewayInfo("push-1", 7000)
+	info.Global.Zone = "z1"
+	info.Profile.Cpu = 30
+	server.InjectRegistration(t, "", info, 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1
+	})
+
+	cc := buildResolver(t, repo, "srvdiscover:///PushGateway?port=grpc")
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(cc.lastAddrs()) == 1
+	})
+	addr := cc.lastAddrs()[0]
+	attrs, ok := GetNodeAttributes(addr)
+	if addr.Addr != "127.0.0.1:7000" || !ok || attrs.NodeId != "push-1" || attrs.Zone != "z1" || attrs.Profile.Cpu != 30 {
+		t.Fatalf("unexpected address %s", addr)
+	}
+
+	//默认只包含online的节点
+	offline := newPushGatewayInfo("push-2", 7002)
+	offline.Global.State = srvDiscover.STATE_OFFLINE
+	server.InjectRegistration(t, "", offline, 30)
+	allStates := buildResolver(t, repo, "srvdiscover:///PushGateway?port=grpc", WithAllStates())
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(allStates.lastAddrs()) == 2
+	})
+	if len(cc.lastAddrs()) != 1 {
+		t.Fatalf("offline node resolved: %v", cc.lastAddrs())
+	}
+
+	//最后一个online节点删除后更新为空地址列表
+	server.RemoveRegistration(t, "", info)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(allStates.lastAddrs()) == 1 && len(cc.lastAddrs()) == 0
+	})
+
+	_, err := NewBuilder(repo).Build(resolver.Target{URL: url.URL{Scheme: Scheme, Path: "/NotSubscribed"}}, new(fakeClientConn), resolver.BuildOptions{})
+	if err == nil {
+		t.Fatal("expect error for unsubscribed service")
+	}
+}
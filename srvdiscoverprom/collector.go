@@ -0,0 +1,128 @@
+// Package srvdiscoverprom 把srvDiscover的注册、订阅和许可状态导出为Prometheus指标
+//
+//	prometheus.MustRegister(srvdiscoverprom.NewCollector(repo))
+//
+// 指标在采集时从Repo.Stats和Repo.DebugInfo读取, 不需要额外的后台协程
+// 两者都不等待etcd请求, 注册失败或者etcd无响应时采集仍然可以立即返回
+package srvdiscoverprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/xukgo/srvDiscover"
+	"strings"
+)
+
+const namespace = "srvdiscover"
+
+// 总是输出的节点状态, 其它状态出现时也会输出
+var nodeStates = []string{srvDiscover.STATE_ONLINE, srvDiscover.STATE_NOTREADY, srvDiscover.STATE_OFFLINE}
+
+var (
+	grantDesc = prometheus.NewDesc(namespace+"_register_grant_total",
+		"Lease grant attempts by result.", []string{"result"}, nil)
+	putDesc = prometheus.NewDesc(namespace+"_register_put_total",
+		"Registration puts by result.", []string{"result"}, nil)
+	keepaliveDesc = prometheus.NewDesc(namespace+"_register_keepalive_total",
+		"Lease keepalive responses and failures by result.", []string{"result"}, nil)
+	registrationUpDesc = prometheus.NewDesc(namespace+"_registration_up",
+		"Whether the last registration attempt succeeded.", []string{"service", "node_id", "lease_group"}, nil)
+
+	watchRestartsDesc = prometheus.NewDesc(namespace+"_watch_restarts_total",
+		"Times the subscription watch has been recreated.", []string{"service"}, nil)
+	watchBackoffDesc = prometheus.NewDesc(namespace+"_watch_backoff_seconds",
+		"Backoff the subscription watch is currently waiting, 0 when connected.", []string{"service"}, nil)
+	watchConnectedDesc = prometheus.NewDesc(namespace+"_watch_connected",
+		"Whether the subscription watch is connected.", []string{"service"}, nil)
+	serviceNodesDesc = prometheus.NewDesc(namespace+"_service_nodes",
+		"Cached nodes of a subscribed service by state.", []string{"service", "state"}, nil)
+	subscriptionRevisionDesc = prometheus.NewDesc(namespace+"_subscription_revision",
+		"Last etcd revision synced for a subscription.", []string{"service"}, nil)
+
+	licenseCodeDesc = prometheus.NewDesc(namespace+"_license_code",
+		"Result code of the license.", nil, nil)
+	licenseExpireDesc = prometheus.NewDesc(namespace+"_license_expire_timestamp_seconds",
+		"Expiry time of the license in unix seconds.", nil, nil)
+)
+
+type collector struct {
+	repo *srvDiscover.Repo
+}
+
+// NewCollector 创建repo的指标采集器
+func NewCollector(repo *srvDiscover.Repo) prometheus.Collector {
+	return &collector{repo: repo}
+}
+
+func (this *collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- grantDesc
+	ch <- putDesc
+	ch <- keepaliveDesc
+	ch <- registrationUpDesc
+	ch <- watchRestartsDesc
+	ch <- watchBackoffDesc
+	ch <- watchConnectedDesc
+	ch <- serviceNodesDesc
+	ch <- subscriptionRevisionDesc
+	ch <- licenseCodeDesc
+	ch <- licenseExpireDesc
+}
+
+func (this *collector) Collect(ch chan<- prometheus.Metric) {
+	stats := this.repo.Stats()
+	collectResult(ch, grantDesc, stats.GrantSuccess, stats.GrantError)
+	collectResult(ch, putDesc, stats.PutSuccess, stats.PutError)
+	collectResult(ch, keepaliveDesc, stats.KeepaliveSuccess, stats.KeepaliveError)
+
+	info := this.repo.DebugInfo()
+	for _, reg := range info.Registrations {
+		ch <- prometheus.MustNewConstMetric(registrationUpDesc, prometheus.GaugeValue,
+			boolValue(reg.LastSaved != nil && len(reg.LastError) == 0), reg.Name, reg.NodeId, reg.LeaseGroup)
+	}
+
+	for _, sub := range info.Subscriptions {
+		ch <- prometheus.MustNewConstMetric(watchRestartsDesc, prometheus.CounterValue, float64(sub.Watch.Restarts), sub.Name)
+		ch <- prometheus.MustNewConstMetric(watchBackoffDesc, prometheus.GaugeValue, sub.Watch.Backoff.Seconds(), sub.Name)
+		ch <- prometheus.MustNewConstMetric(watchConnectedDesc, prometheus.GaugeValue, boolValue(sub.Watch.Connected), sub.Name)
+		ch <- prometheus.MustNewConstMetric(subscriptionRevisionDesc, prometheus.GaugeValue, float64(sub.Revision), sub.Name)
+
+		counts := make(map[string]int, len(nodeStates))
+		for _, state := range nodeStates {
+			counts[state] = 0
+		}
+		for _, node := range sub.Nodes {
+			counts[normalizeState(node.State)]++
+		}
+		for state, count := range counts {
+			ch <- prometheus.MustNewConstMetric(serviceNodesDesc, prometheus.GaugeValue, float64(count), sub.Name, state)
+		}
+	}
+
+	if info.License != nil && info.License.Info != nil {
+		if info.License.Info.Result != nil {
+			ch <- prometheus.MustNewConstMetric(licenseCodeDesc, prometheus.GaugeValue, float64(info.License.Info.Result.Code))
+		}
+		ch <- prometheus.MustNewConstMetric(licenseExpireDesc, prometheus.GaugeValue, float64(info.License.Info.ExpireTimestamp))
+	}
+}
+
+func collectResult(ch chan<- prometheus.Metric, desc *prometheus.Desc, success int64, failure int64) {
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(success), "success")
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(failure), "error")
+}
+
+// 状态不区分大小写, 统一为常量的写法
+func normalizeState(state string) string {
+	for _, item := range nodeStates {
+		if strings.EqualFold(item, state) {
+			return item
+		}
+	}
+	return state
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
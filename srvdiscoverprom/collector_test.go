@@ -0,0 +1,150 @@
+package srvdiscoverprom
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/xukgo/srvDiscover"
+	"github.com/xukgo/srvDiscover/srvdiscovertest"
+	"testing"
+	"time"
+)
+
+const conf = `<SrvDiscover>
+    <Register>
+        <Global>
+            <Name>CallCenter</Name>
+            <Version>CallCenter-1.0.0</Version>
+            <PrivateIP>127.0.0.1</PrivateIP>
+        </Global>
+    </Register>
+    <Subscribe>
+        <Service>
+            <Name>PushGateway</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+func gatherValues(t *testing.T, registry *prometheus.Registry) map[string]map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]map[string]float64)
+	for _, family := range families {
+		values[family.GetName()] = make(map[string]float64)
+		for _, metric := range family.GetMetric() {
+			values[family.GetName()][labelKey(metric)] = metricValue(metric)
+		}
+	}
+	return values
+}
+
+// 所有label的值用逗号连接
+func labelKey(metric *dto.Metric) string {
+	key := ""
+	for idx, label := range metric.GetLabel() {
+		if idx > 0 {
+			key += ","
+		}
+		key += label.GetValue()
+	}
+	return key
+}
+
+func metricValue(metric *dto.Metric) float64 {
+	if metric.GetCounter() != nil {
+		return metric.GetCounter().GetValue()
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func Test_Collector(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, conf)
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for nodeId, state := range map[string]string{"push-1": srvDiscover.STATE_ONLINE, "push-2": srvDiscover.STATE_OFFLINE} {
+		info := new(srvDiscover.RegisterInfo)
+		info.Global.Name = "PushGateway"
+		info.Global.NodeId = nodeId
+		info.Global.Version = "PushGateway-1.0.0"
+		info.Global.PrivateIp = "127.0.0.1"
+		info.Global.State = state
+		server.InjectRegistration(t, "", info, 30)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(repo))
+
+	var values map[string]map[string]float64
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		values = gatherValues(t, registry)
+		return values["srvdiscover_service_nodes"]["PushGateway,online"] == 1 &&
+			values["srvdiscover_service_nodes"]["PushGateway,offline"] == 1 &&
+			values["srvdiscover_register_put_total"]["success"] >= 1
+	})
+
+	if values["srvdiscover_service_nodes"]["PushGateway,notReady"] != 0 {
+		t.Fatalf("unexpected node gauges: %v", values["srvdiscover_service_nodes"])
+	}
+	if values["srvdiscover_register_grant_total"]["success"] < 1 || values["srvdiscover_register_grant_total"]["error"] != 0 {
+		t.Fatalf("unexpected grant counters: %v", values["srvdiscover_register_grant_total"])
+	}
+	if values["srvdiscover_subscription_revision"]["PushGateway"] == 0 || values["srvdiscover_watch_connected"]["PushGateway"] != 1 {
+		t.Fatalf("unexpected subscription metrics: %v %v", values["srvdiscover_subscription_revision"], values["srvdiscover_watch_connected"])
+	}
+	if _, ok := values["srvdiscover_license_code"]; ok {
+		t.Fatal("license metrics without license")
+	}
+}
+
+// etcd的Put无响应时采集不被阻塞, 注册指标仍然输出
+func Test_CollectorPutHang(t *testing.T) {
+	backend := srvdiscovertest.NewMemoryBackend()
+	repo := backend.NewRepo(t, conf)
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewCollector(repo))
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return gatherValues(t, registry)["srvdiscover_register_put_total"]["success"] >= 1
+	})
+
+	//在repo Close之前恢复, 注册协程才能退出
+	release := backend.HoldPut()
+	t.Cleanup(release)
+	repo.UpdateOnce()
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return backend.HeldPuts() == 1
+	})
+
+	done := make(chan map[string]map[string]float64, 1)
+	go func() {
+		done <- gatherValues(t, registry)
+	}()
+	select {
+	case values := <-done:
+		if len(values["srvdiscover_registration_up"]) != 1 {
+			t.Fatalf("unexpected registration_up: %v", values["srvdiscover_registration_up"])
+		}
+		for labels, value := range values["srvdiscover_registration_up"] {
+			if value != 1 {
+				t.Fatalf("registration %s is down", labels)
+			}
+		}
+		if values["srvdiscover_register_put_total"]["success"] < 1 {
+			t.Fatalf("unexpected put counters: %v", values["srvdiscover_register_put_total"])
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("collect blocked by hanging put")
+	}
+}
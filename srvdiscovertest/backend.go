@@ -0,0 +1,304 @@
+package srvdiscovertest
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/srvDiscover"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// MemoryBackend 内存实现的srvDiscover.Backend, 不需要etcd即可测试注册和订阅
+// 多个Repo可以共用一个MemoryBackend, Close不会清除数据
+type MemoryBackend struct {
+	locker   sync.Mutex
+	revision int64
+	leaseSeq int64
+	kvs      map[string]srvDiscover.KeyValue
+	leases   map[srvDiscover.LeaseID]chan struct{} //lease撤销时关闭
+	history  []srvDiscover.Event                   //所有事件, 用于从指定revision开始watch
+	watchers map[*memoryWatcher]struct{}
+	putHold  chan struct{} //不为nil时Put阻塞直到关闭
+	heldPuts atomic.Int64
+}
+
+type memoryWatcher struct {
+	prefix string
+	signal chan struct{}
+	events []srvDiscover.Event
+}
+
+// KEEPALIVE_INTERVAL MemoryBackend续约应答的间隔
+const KEEPALIVE_INTERVAL = 200 * time.Millisecond
+
+var _ srvDiscover.Backend = (*MemoryBackend)(nil)
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		kvs:      make(map[string]srvDiscover.KeyValue),
+		leases:   make(map[srvDiscover.LeaseID]chan struct{}),
+		watchers: make(map[*memoryWatcher]struct{}),
+	}
+}
+
+// ttlSec被忽略, lease只在Revoke或者ExpireLease时失效
+func (this *MemoryBackend) Grant(ctx context.Context, ttlSec int64) (srvDiscover.LeaseID, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	this.leaseSeq++
+	id := srvDiscover.LeaseID(this.leaseSeq)
+	this.leases[id] = make(chan struct{})
+	return id, nil
+}
+
+func (this *MemoryBackend) KeepAlive(ctx context.Context, id srvDiscover.LeaseID) (<-chan struct{}, error) {
+	this.locker.Lock()
+	revoked, ok := this.leases[id]
+	this.locker.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("lease %d not found", id)
+	}
+
+	out := make(chan struct{})
+	go func() {
+		defer close(out)
+		ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-revoked:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case out <- struct{}{}:
+			case <-ctx.Done():
+				return
+			case <-revoked:
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (this *MemoryBackend) Revoke(ctx context.Context, id srvDiscover.LeaseID) error {
+	this.ExpireLease(id)
+	return nil
+}
+
+// ExpireLease 模拟lease过期, 删除绑定的key并关闭续约channel
+func (this *MemoryBackend) ExpireLease(id srvDiscover.LeaseID) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	revoked, ok := this.leases[id]
+	if !ok {
+		return
+	}
+	close(revoked)
+	delete(this.leases, id)
+	for key, kv := range this.kvs {
+		if kv.Lease == id {
+			this.deleteKey(key)
+		}
+	}
+}
+
+// HoldPut 使之后的Put一直阻塞并且不响应ctx, 模拟etcd无响应, 调用返回的release后恢复
+func (this *MemoryBackend) HoldPut() (release func()) {
+	hold := make(chan struct{})
+	this.locker.Lock()
+	this.putHold = hold
+	this.locker.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			this.locker.Lock()
+			if this.putHold == hold {
+				this.putHold = nil
+			}
+			this.locker.Unlock()
+			close(hold)
+		})
+	}
+}
+
+// HeldPuts 被HoldPut阻塞的Put数量
+func (this *MemoryBackend) HeldPuts() int {
+	return int(this.heldPuts.Load())
+}
+
+func (this *MemoryBackend) Put(ctx context.Context, key, value string, lease srvDiscover.LeaseID) (int64, error) {
+	this.locker.Lock()
+	hold := this.putHold
+	this.locker.Unlock()
+	if hold != nil {
+		this.heldPuts.Add(1)
+		<-hold
+		this.heldPuts.Add(-1)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if lease != srvDiscover.NoLease {
+		if _, ok := this.leases[lease]; !ok {
+			return 0, fmt.Errorf("lease %d not found", lease)
+		}
+	}
+	this.revision++
+	kv := srvDiscover.KeyValue{
+		Key:         []byte(key),
+		Value:       []byte(value),
+		ModRevision: this.revision,
+		Lease:       lease,
+	}
+	this.kvs[key] = kv
+	this.publish(srvDiscover.Event{Type: srvDiscover.EventPut, Kv: kv})
+	return this.revision, nil
+}
+
+func (this *MemoryBackend) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	if _, ok := this.kvs[key]; ok {
+		this.deleteKey(key)
+	}
+	return nil
+}
+
+// 调用方需要持有locker
+func (this *MemoryBackend) deleteKey(key string) {
+	this.revision++
+	delete(this.kvs, key)
+	this.publish(srvDiscover.Event{
+		Type: srvDiscover.EventDelete,
+		Kv:   srvDiscover.KeyValue{Key: []byte(key), ModRevision: this.revision},
+	})
+}
+
+// 记录事件并通知匹配的watcher, 调用方需要持有locker
+func (this *MemoryBackend) publish(event srvDiscover.Event) {
+	this.history = append(this.history, event)
+	for watcher := range this.watchers {
+		if strings.HasPrefix(string(event.Kv.Key), watcher.prefix) {
+			watcher.events = append(watcher.events, event)
+			watcher.notify()
+		}
+	}
+}
+
+func (this *MemoryBackend) GetPrefix(ctx context.Context, prefix string) ([]srvDiscover.KeyValue, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	kvs := make([]srvDiscover.KeyValue, 0, len(this.kvs))
+	for key, kv := range this.kvs {
+		if strings.HasPrefix(key, prefix) {
+			kvs = append(kvs, kv)
+		}
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return string(kvs[i].Key) < string(kvs[j].Key)
+	})
+	return kvs, this.revision, nil
+}
+
+func (this *MemoryBackend) WatchPrefix(ctx context.Context, prefix string, revision int64) <-chan srvDiscover.WatchResponse {
+	watcher := &memoryWatcher{
+		prefix: prefix,
+		signal: make(chan struct{}, 1),
+	}
+
+	this.locker.Lock()
+	if revision > 0 {
+		for _, event := range this.history {
+			if event.Kv.ModRevision >= revision && strings.HasPrefix(string(event.Kv.Key), prefix) {
+				watcher.events = append(watcher.events, event)
+			}
+		}
+		watcher.notify()
+	}
+	this.watchers[watcher] = struct{}{}
+	this.locker.Unlock()
+
+	out := make(chan srvDiscover.WatchResponse)
+	go func() {
+		defer close(out)
+		defer func() {
+			this.locker.Lock()
+			delete(this.watchers, watcher)
+			this.locker.Unlock()
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.signal:
+			}
+
+			this.locker.Lock()
+			events := watcher.events
+			watcher.events = nil
+			this.locker.Unlock()
+
+			for _, event := range events {
+				resp := srvDiscover.WatchResponse{
+					Events:   []srvDiscover.Event{event},
+					Revision: event.Kv.ModRevision,
+				}
+				select {
+				case out <- resp:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// NewRepo 使用xml配置创建连接到此backend的Repo, conf为空时使用不含注册和订阅的最小配置
+// 测试结束时自动Close
+func (this *MemoryBackend) NewRepo(tb testing.TB, conf string) *srvDiscover.Repo {
+	tb.Helper()
+	return NewRepoWithBackend(tb, this, conf)
+}
+
+func (this *memoryWatcher) notify() {
+	select {
+	case this.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (this *MemoryBackend) Ping(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (this *MemoryBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,223 @@
+// Package srvdiscovertest 提供嵌入式etcd的测试环境, 用于在单元测试中验证注册和订阅
+package srvdiscovertest
+
+import (
+	"context"
+	"fmt"
+	"github.com/xukgo/srvDiscover"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 不包含注册和订阅的最小配置
+const minimalConf = `<SrvDiscover><Timeout>2</Timeout></SrvDiscover>`
+
+// Server 运行在临时目录和随机端口上的嵌入式etcd
+type Server struct {
+	etcd     *embed.Etcd
+	client   *clientv3.Client
+	endpoint string
+}
+
+// StartServer 启动嵌入式etcd, 测试结束时自动关闭
+func StartServer(tb testing.TB) *Server {
+	tb.Helper()
+
+	clientUrl := freeLocalUrl(tb)
+	peerUrl := freeLocalUrl(tb)
+
+	cfg := embed.NewConfig()
+	cfg.Dir = tb.TempDir()
+	cfg.ListenClientUrls = []url.URL{clientUrl}
+	cfg.AdvertiseClientUrls = []url.URL{clientUrl}
+	cfg.ListenPeerUrls = []url.URL{peerUrl}
+	cfg.AdvertisePeerUrls = []url.URL{peerUrl}
+	cfg.InitialCluster = fmt.Sprintf("%s=%s", cfg.Name, peerUrl.String())
+	cfg.LogLevel = "error"
+
+	etcd, err := embed.StartEtcd(cfg)
+	if err != nil {
+		tb.Fatalf("start embed etcd error:%s", err.Error())
+	}
+	tb.Cleanup(etcd.Close)
+
+	select {
+	case <-etcd.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		tb.Fatalf("embed etcd start timeout")
+	}
+
+	server := &Server{
+		etcd:     etcd,
+		endpoint: clientUrl.Host,
+	}
+	server.client, err = clientv3.New(clientv3.Config{
+		Endpoints:   []string{server.endpoint},
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("create etcd client error:%s", err.Error())
+	}
+	tb.Cleanup(func() {
+		_ = server.client.Close()
+	})
+	return server
+}
+
+func (this *Server) Endpoint() string {
+	return this.endpoint
+}
+
+// Client 测试代码直接操作etcd用的客户端
+func (this *Server) Client() *clientv3.Client {
+	return this.client
+}
+
+// NewRepo 使用xml配置创建连接到嵌入式etcd的Repo, conf为空时使用不含注册和订阅的最小配置
+// 配置里的Endpoints和Tls会被忽略, 测试结束时自动Close
+func (this *Server) NewRepo(tb testing.TB, conf string) *srvDiscover.Repo {
+	tb.Helper()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{this.endpoint},
+		DialTimeout: 2 * time.Second,
+	})
+	if err != nil {
+		tb.Fatalf("create etcd client error:%s", err.Error())
+	}
+
+	return NewRepoWithBackend(tb, srvDiscover.NewEtcdBackend(client), conf)
+}
+
+// NewRepoWithBackend 使用xml配置和指定的backend创建Repo, conf为空时使用不含注册和订阅的最小配置
+// 测试结束时自动Close, Close会同时关闭backend
+func NewRepoWithBackend(tb testing.TB, backend srvDiscover.Backend, conf string) *srvDiscover.Repo {
+	tb.Helper()
+
+	if len(strings.TrimSpace(conf)) == 0 {
+		conf = minimalConf
+	}
+
+	repo := new(srvDiscover.Repo)
+	repo.WithBackend(backend)
+	err := repo.InitFromReader(strings.NewReader(conf))
+	if err != nil {
+		_ = backend.Close()
+		tb.Fatalf("init repo error:%s", err.Error())
+	}
+	tb.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = repo.Close(ctx)
+	})
+	return repo
+}
+
+// InjectRegistration 模拟其它节点注册, 返回绑定的lease, ttlSec<=0时不绑定lease
+func (this *Server) InjectRegistration(tb testing.TB, namespace string, info *srvDiscover.RegisterInfo, ttlSec int64) clientv3.LeaseID {
+	tb.Helper()
+
+	if len(namespace) == 0 {
+		namespace = srvDiscover.DEFAULT_NAMESPACE
+	}
+	if len(info.Global.State) == 0 {
+		info.Global.State = srvDiscover.STATE_ONLINE
+	}
+	info.Global.RefreshTimestamp(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var lease clientv3.LeaseID = clientv3.NoLease
+	var opts []clientv3.OpOption
+	if ttlSec > 0 {
+		resp, err := this.client.Grant(ctx, ttlSec)
+		if err != nil {
+			tb.Fatalf("grant lease error:%s", err.Error())
+		}
+		lease = resp.ID
+		opts = append(opts, clientv3.WithLease(lease))
+	}
+
+	_, err := this.client.Put(ctx, info.FormatRegisterKey(namespace), string(info.Serialize()), opts...)
+	if err != nil {
+		tb.Fatalf("put registration error:%s", err.Error())
+	}
+	return lease
+}
+
+// ExpireRegistration 撤销lease, 模拟节点租约过期
+func (this *Server) ExpireRegistration(tb testing.TB, lease clientv3.LeaseID) {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := this.client.Revoke(ctx, lease)
+	if err != nil {
+		tb.Fatalf("revoke lease error:%s", err.Error())
+	}
+}
+
+// RemoveRegistration 直接删除注册的key
+func (this *Server) RemoveRegistration(tb testing.TB, namespace string, info *srvDiscover.RegisterInfo) {
+	tb.Helper()
+
+	if len(namespace) == 0 {
+		namespace = srvDiscover.DEFAULT_NAMESPACE
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := this.client.Delete(ctx, info.FormatRegisterKey(namespace))
+	if err != nil {
+		tb.Fatalf("delete registration error:%s", err.Error())
+	}
+}
+
+// Keys 返回前缀下的所有key
+func (this *Server) Keys(tb testing.TB, prefix string) []string {
+	tb.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := this.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		tb.Fatalf("get keys error:%s", err.Error())
+	}
+	keys := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		keys = append(keys, string(kv.Key))
+	}
+	return keys
+}
+
+// Eventually 在timeout内轮询直到cond返回true, 否则测试失败
+func Eventually(tb testing.TB, timeout time.Duration, cond func() bool) {
+	tb.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			tb.Fatalf("condition not met in %s", timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func freeLocalUrl(tb testing.TB) url.URL {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen random port error:%s", err.Error())
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return url.URL{Scheme: "http", Host: addr}
+}
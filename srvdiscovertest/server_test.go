@@ -0,0 +1,121 @@
+package srvdiscovertest
+
+import (
+	"context"
+	"github.com/xukgo/srvDiscover"
+	"strings"
+	"testing"
+	"time"
+)
+
+const registerConf = `<SrvDiscover>
+    <Register>
+        <TTL>10</TTL>
+        <Global>
+            <Name>CallCenter</Name>
+            <NodeId>node-1</NodeId>
+            <Version>CallCenter-1.0.0</Version>
+            <PrivateIP>127.0.0.1</PrivateIP>
+        </Global>
+    </Register>
+    <Subscribe>
+        <Service>
+            <Name>PushGateway</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+func newRegisterInfo(name string, nodeId string) *srvDiscover.RegisterInfo {
+	info := new(srvDiscover.RegisterInfo)
+	info.Global.Name = name
+	info.Global.NodeId = nodeId
+	info.Global.Version = name + "-1.0.0"
+	info.Global.PrivateIp = "127.0.0.1"
+	return info
+}
+
+func TestRegisterAndClose(t *testing.T) {
+	server := StartServer(t)
+	repo := server.NewRepo(t, registerConf)
+
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Eventually(t, 5*time.Second, func() bool {
+		return len(server.Keys(t, "/registry.voice.CallCenter")) == 1
+	})
+
+	err = repo.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//Close撤销lease, key立即消失
+	keys := server.Keys(t, "/registry.voice.CallCenter")
+	if len(keys) != 0 {
+		t.Fatalf("keys not removed after close: %v", keys)
+	}
+}
+
+func TestSubscribeInjectAndExpire(t *testing.T) {
+	server := StartServer(t)
+	repo := server.NewRepo(t, registerConf)
+
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := newRegisterInfo("PushGateway", "node-2")
+	server.InjectRegistration(t, "", info, 30)
+	Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1
+	})
+
+	ok, node := repo.GetServiceByNameAndNodeId("PushGateway", "node-2")
+	if !ok || node.Global.PrivateIp != "127.0.0.1" {
+		t.Fatalf("unexpected node: %v %+v", ok, node)
+	}
+
+	countAll := func() int {
+		return repo.GetFilterServiceCount("PushGateway", func(*srvDiscover.SrvNodeInfo) bool { return true })
+	}
+
+	//状态变为offline后不再返回, 但仍在缓存里
+	info.Global.State = srvDiscover.STATE_OFFLINE
+	lease := server.InjectRegistration(t, "", info, 30)
+	Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 0 && countAll() == 1
+	})
+
+	server.ExpireRegistration(t, lease)
+	Eventually(t, 5*time.Second, func() bool {
+		return countAll() == 0
+	})
+
+	info.Global.State = srvDiscover.STATE_ONLINE
+	server.InjectRegistration(t, "", info, 0)
+	Eventually(t, 5*time.Second, func() bool {
+		return countAll() == 1
+	})
+	server.RemoveRegistration(t, "", info)
+	Eventually(t, 5*time.Second, func() bool {
+		return countAll() == 0
+	})
+}
+
+func TestNewRepoMinimalConf(t *testing.T) {
+	server := StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	kvs, err := repo.GetPrefixKvs("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Fatalf("unexpected kvs: %d", len(kvs))
+	}
+	if !strings.Contains(server.Endpoint(), "127.0.0.1:") {
+		t.Fatalf("unexpected endpoint: %s", server.Endpoint())
+	}
+}
@@ -1,34 +1,1604 @@
-package srvDiscover
+package srvDiscover_test
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/xukgo/srvDiscover"
+	"github.com/xukgo/srvDiscover/srvdiscovertest"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
+// 读取SrvDiscover.xml, 测试环境不一定有配置里的网段, PrivateIP替换为127.0.0.1
+func loadConfFixture(t *testing.T) string {
+	t.Helper()
+	content, err := os.ReadFile("SrvDiscover.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return regexp.MustCompile(`<PrivateIP>.*</PrivateIP>`).ReplaceAllString(string(content), "<PrivateIP>127.0.0.1</PrivateIP>")
+}
+
 func Test_initConf(t *testing.T) {
-	fi, err := os.Open("SrvDiscover.xml")
+	conf := loadConfFixture(t)
+
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, conf)
+
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := new(srvDiscover.RegisterInfo)
+	info.Global.Name = "PushGateway"
+	info.Global.NodeId = "push-1"
+	info.Global.Version = "PushGateway-1.0.0"
+	info.Global.PrivateIp = "127.0.0.1"
+	server.InjectRegistration(t, "", info, 30)
+
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		ok, _ := repo.GetRandomServiceByName("PushGateway")
+		return ok
+	})
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(server.Keys(t, "/registry.voice.CallCenter")) == 1
+	})
+}
+
+const subscribeConf = `<SrvDiscover>
+    <Subscribe>
+        <Service>
+            <Name>PushGateway</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+func newPushGatewayInfo(nodeId string) *srvDiscover.RegisterInfo {
+	info := new(srvDiscover.RegisterInfo)
+	info.Global.Name = "PushGateway"
+	info.Global.NodeId = nodeId
+	info.Global.Version = "PushGateway-1.0.0"
+	info.Global.PrivateIp = "127.0.0.1"
+	return info
+}
+
+func Test_OnServiceChange(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+
+	changes := make(chan srvDiscover.ServiceChange, 16)
+	cancel := repo.OnServiceChange("pushgateway", func(change srvDiscover.ServiceChange) {
+		changes <- change
+	})
+	defer cancel()
+
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lease := server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	change := waitServiceChange(t, changes)
+	if len(change.Added) != 1 || change.Added[0].Global.NodeId != "push-1" || change.Revision == 0 {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	server.ExpireRegistration(t, lease)
+	change = waitServiceChange(t, changes)
+	if len(change.Removed) != 1 || change.Removed[0].Global.NodeId != "push-1" {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+}
+
+func waitServiceChange(t *testing.T, changes chan srvDiscover.ServiceChange) srvDiscover.ServiceChange {
+	t.Helper()
+
+	select {
+	case change := <-changes:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait service change timeout")
+	}
+	return srvDiscover.ServiceChange{}
+}
+
+func Test_WatchService(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := repo.WatchService(ctx, "PushGateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event := waitServiceEvent(t, events)
+	if event.Type != srvDiscover.ServiceEventSnapshot || len(event.Nodes) != 1 {
+		t.Fatalf("unexpected first event: %+v", event)
+	}
+
+	lease := server.InjectRegistration(t, "", newPushGatewayInfo("push-2"), 30)
+	event = waitServiceEvent(t, events)
+	if event.Type != srvDiscover.ServiceEventPut || len(event.Nodes) != 1 || event.Nodes[0].Global.NodeId != "push-2" {
+		t.Fatalf("unexpected put event: %+v", event)
+	}
+
+	server.ExpireRegistration(t, lease)
+	event = waitServiceEvent(t, events)
+	if event.Type != srvDiscover.ServiceEventDelete || len(event.Nodes) != 1 || event.Nodes[0].Global.NodeId != "push-2" {
+		t.Fatalf("unexpected delete event: %+v", event)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-events:
+		if ok {
+			t.Fatal("channel not closed after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after cancel")
+	}
+
+	_, err = repo.WatchService(context.Background(), "NotSubscribed")
+	if err == nil {
+		t.Fatal("expect error for unsubscribed service")
+	}
+}
+
+func waitServiceEvent(t *testing.T, events <-chan srvDiscover.ServiceEvent) srvDiscover.ServiceEvent {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait service event timeout")
+	}
+	return srvDiscover.ServiceEvent{}
+}
+
+func Test_SubscribeRuntime(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	err := repo.Subscribe(srvDiscover.SubBasicInfo{Name: "PushGateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1
+	})
+	err = repo.Subscribe(srvDiscover.SubBasicInfo{Name: "pushgateway"})
+	if err == nil {
+		t.Fatal("expect error for duplicate subscribe")
+	}
+	if names := repo.GetSubsNames(); len(names) != 1 || names[0] != "PushGateway" {
+		t.Fatalf("unexpected subscribe names: %v", names)
+	}
+
+	changes := make(chan srvDiscover.ServiceChange, 16)
+	cancel := repo.OnServiceChange("PushGateway", func(change srvDiscover.ServiceChange) {
+		changes <- change
+	})
+	defer cancel()
+
+	err = repo.Unsubscribe("pushgateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	change := waitServiceChange(t, changes)
+	if len(change.Removed) != 1 || change.Removed[0].Global.NodeId != "push-1" {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	if len(repo.GetServiceByName("PushGateway")) != 0 {
+		t.Fatal("cache not removed after unsubscribe")
+	}
+	if names := repo.GetSubsNames(); len(names) != 0 {
+		t.Fatalf("unsubscribed service still listed: %v", names)
+	}
+
+	//取消订阅后不再收到变化
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-2"), 30)
+	select {
+	case change = <-changes:
+		t.Fatalf("unexpected change after unsubscribe: %+v", change)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	err = repo.Unsubscribe("PushGateway")
+	if err == nil {
+		t.Fatal("expect error for unsubscribed service")
+	}
+}
+
+func Test_WaitForInstances(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = repo.WaitSynced(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- repo.WaitForInstances(ctx, "pushgateway", 2)
+	}()
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-2"), 30)
+	select {
+	case err = <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait for instances timeout")
+	}
+	if len(repo.GetServiceByName("PushGateway")) != 2 {
+		t.Fatal("expect 2 instances after wait")
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer shortCancel()
+	err = repo.WaitForInstances(shortCtx, "PushGateway", 3)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expect deadline exceeded, got %v", err)
+	}
+
+	err = repo.WaitForInstances(ctx, "NotSubscribed", 1)
+	if err == nil {
+		t.Fatal("expect error for unsubscribed service")
+	}
+}
+
+func newRestfulInfo(nodeId string, addr string) *srvDiscover.RegisterInfo {
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	info := newPushGatewayInfo(nodeId)
+	info.Global.PrivateIp = host
+	info.SvcInfos = []srvDiscover.RegisterSvcDefineConf{{Name: "restful", Port: port}}
+	return info
+}
+
+// 返回一个已经关闭的本地地址, 连接会被拒绝
+func closedLocalAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	_ = listener.Close()
+	return addr
+}
+
+func Test_ServiceTransport(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.URL.Path + ":" + string(body)))
+	}))
+	defer httpServer.Close()
+	server.InjectRegistration(t, "", newRestfulInfo("push-1", httpServer.Listener.Addr().String()), 30)
+	server.InjectRegistration(t, "", newRestfulInfo("push-2", closedLocalAddr(t)), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 2
+	})
+
+	client := &http.Client{Transport: srvDiscover.NewServiceTransport(repo, nil)}
+	//无论轮询到哪个节点, 连接失败的节点都会换下一个节点重试
+	for i := 0; i < 4; i++ {
+		req, err := srvDiscover.NewServiceRequest(context.Background(), http.MethodPost, "http://PushGateway:restful/hello?x=1", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) != "/hello:body" {
+			t.Fatalf("unexpected body %s", body)
+		}
+	}
+
+	//普通地址直接透传
+	resp, err := client.Get(httpServer.URL + "/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	req, _ := srvDiscover.NewServiceRequest(context.Background(), http.MethodGet, "http://PushGateway:grpc/", nil)
+	_, err = client.Do(req)
+	if err == nil {
+		t.Fatal("expect error for unknown port name")
+	}
+}
+
+// 启动返回节点id的http服务并注册为PushGateway节点
+func startNodeServers(t *testing.T, server *srvdiscovertest.Server, nodeIds ...string) {
+	for _, nodeId := range nodeIds {
+		nodeId := nodeId
+		httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(nodeId))
+		}))
+		t.Cleanup(httpServer.Close)
+		server.InjectRegistration(t, "", newRestfulInfo(nodeId, httpServer.Listener.Addr().String()), 30)
+	}
+}
+
+func Test_ServiceTransportRoundRobin(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startNodeServers(t, server, "push-1", "push-2")
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 2
+	})
+
+	//两个节点都正常时每个请求只选一次节点, 请求轮流发往两个节点
+	client := &http.Client{Transport: srvDiscover.NewServiceTransport(repo, nil)}
+	counts := make(map[string]int)
+	last := ""
+	for i := 0; i < 6; i++ {
+		req, err := srvDiscover.NewServiceRequest(context.Background(), http.MethodGet, "http://PushGateway:restful/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if string(body) == last {
+			t.Fatalf("request %d sent to %s again", i, last)
+		}
+		last = string(body)
+		counts[last]++
+	}
+	if counts["push-1"] != 3 || counts["push-2"] != 3 {
+		t.Fatalf("requests not spread: %v", counts)
+	}
+}
+
+func Test_ServiceTransportHint(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
 	if err != nil {
-		t.FailNow()
+		t.Fatal(err)
+	}
+	err = repo.SetPicker("PushGateway", srvDiscover.NewConsistentHashPicker(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	startNodeServers(t, server, "push-1", "push-2", "push-3")
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 3
+	})
+
+	transport := srvDiscover.NewServiceTransport(repo, nil)
+	transport.HintHeader = "X-Call-Id"
+	client := &http.Client{Transport: transport}
+	get := func(ctx context.Context, header string) string {
+		req, err := srvDiscover.NewServiceRequest(ctx, http.MethodGet, "http://PushGateway:restful/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(header) > 0 {
+			req.Header.Set("X-Call-Id", header)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return string(body)
 	}
-	defer fi.Close()
 
-	repo := new(Repo)
-	err = repo.InitFromReader(fi)
+	//相同的hint总是发往同一个节点, 不同的hint分散到各个节点
+	nodes := make(map[string]bool)
+	for i := 0; i < 30; i++ {
+		hint := fmt.Sprintf("call-%d", i)
+		_, expect := repo.GetServiceByHashKey("PushGateway", hint)
+		ctx := srvDiscover.WithPickHint(context.Background(), hint)
+		for n := 0; n < 3; n++ {
+			if nodeId := get(ctx, ""); nodeId != expect.Global.NodeId {
+				t.Fatalf("hint %s sent to %s, expect %s", hint, nodeId, expect.Global.NodeId)
+			}
+		}
+		if nodeId := get(context.Background(), hint); nodeId != expect.Global.NodeId {
+			t.Fatalf("header hint %s sent to %s, expect %s", hint, nodeId, expect.Global.NodeId)
+		}
+		nodes[expect.Global.NodeId] = true
+	}
+	if len(nodes) != 3 {
+		t.Fatalf("hints not spread: %v", nodes)
+	}
+}
+
+func Test_ServiceTransportInFlight(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
 	if err != nil {
-		t.FailNow()
+		t.Fatal(err)
+	}
+
+	finish := make(chan struct{})
+	httpServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-finish
+		_, _ = w.Write([]byte("done"))
+	}))
+	defer httpServer.Close()
+	server.InjectRegistration(t, "", newRestfulInfo("push-1", httpServer.Listener.Addr().String()), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1
+	})
+	inflight := func() int64 {
+		return repo.DebugInfo().Subscriptions[0].Nodes[0].InFlight
 	}
 
-	err = repo.StartRegister(nil, nil)
+	client := &http.Client{Transport: srvDiscover.NewServiceTransport(repo, nil)}
+	req, err := srvDiscover.NewServiceRequest(context.Background(), http.MethodGet, "http://PushGateway:restful/", nil)
 	if err != nil {
-		t.FailNow()
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		close(finish)
+		t.Fatal(err)
+	}
+	//响应体读完并关闭之前请求仍在进行
+	if count := inflight(); count != 1 {
+		close(finish)
+		t.Fatalf("unexpected inflight %d", count)
+	}
+	close(finish)
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "done" || inflight() != 1 {
+		t.Fatalf("unexpected body %s, inflight %d", body, inflight())
+	}
+	_ = resp.Body.Close()
+	_ = resp.Body.Close()
+	if count := inflight(); count != 0 {
+		t.Fatalf("inflight not released: %d", count)
+	}
+
+	//连接失败时立即释放
+	server.InjectRegistration(t, "", newRestfulInfo("push-1", closedLocalAddr(t)), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		infos := repo.GetServiceByName("PushGateway")
+		return len(infos) == 1 && infos[0].SvcInfos[0].Port != httpServer.Listener.Addr().(*net.TCPAddr).Port
+	})
+	req, _ = srvDiscover.NewServiceRequest(context.Background(), http.MethodGet, "http://PushGateway:restful/", nil)
+	_, err = client.Do(req)
+	if err == nil {
+		t.Fatal("expect dial error")
+	}
+	if count := inflight(); count != 0 {
+		t.Fatalf("inflight not released after error: %d", count)
+	}
+}
+
+func Test_DialContext(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("hello"))
+			_ = conn.Close()
+		}
+	}()
+
+	online := newRestfulInfo("push-1", listener.Addr().String())
+	online.Global.PublicIP = "127.0.0.2"
+	server.InjectRegistration(t, "", online, 30)
+	server.InjectRegistration(t, "", newRestfulInfo("push-2", closedLocalAddr(t)), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 4; i++ {
+		conn, err := repo.DialContext(ctx, "tcp", "PushGateway:restful")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.RemoteAddr().String() != listener.Addr().String() {
+			t.Fatalf("unexpected remote addr %s", conn.RemoteAddr())
+		}
+		_ = conn.Close()
+	}
+
+	//使用PublicIP时push-2没有PublicIP被跳过, push-1的PublicIP上没有监听
+	dialer := srvDiscover.NewServiceDialer(repo)
+	dialer.UsePublicIP = true
+	_, err = dialer.DialContext(ctx, "tcp", "PushGateway:restful")
+	if err == nil || !strings.Contains(err.Error(), "127.0.0.2") {
+		t.Fatalf("public ip not used: %v", err)
+	}
+
+	_, err = repo.DialContext(ctx, "tcp", "PushGateway:grpc")
+	if err == nil {
+		t.Fatal("expect error for unknown port name")
+	}
+}
+
+func Test_DebugHandler(t *testing.T) {
+	conf := loadConfFixture(t)
+
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, conf)
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
 	}
 	err = repo.StartSubscribe()
 	if err != nil {
-		t.FailNow()
+		t.Fatal(err)
+	}
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 1 && len(repo.Registrations()) == 1 && len(repo.Registrations()[0].Key()) > 0
+	})
+
+	httpServer := httptest.NewServer(repo.DebugHandler())
+	defer httpServer.Close()
+	resp, err := http.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var info srvDiscover.DebugInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Registrations) != 1 || info.Registrations[0].Name != "CallCenter" || len(info.Registrations[0].Key) == 0 {
+		t.Fatalf("unexpected registrations: %+v", info.Registrations)
+	}
+	if len(info.Subscriptions) != 2 || info.Subscriptions[0].Name != "PushGateway" {
+		t.Fatalf("unexpected subscriptions: %+v", info.Subscriptions)
+	}
+	sub := info.Subscriptions[0]
+	if !sub.Synced || !sub.Watch.Connected || sub.Revision == 0 || len(sub.Nodes) != 1 || sub.Nodes[0].NodeId != "push-1" || sub.Nodes[0].ModRevision == 0 {
+		t.Fatalf("unexpected subscription: %+v", sub)
+	}
+}
+
+// 并发安全的日志输出
+// etcd无响应或者BeforeRegister阻塞时DebugHandler仍然可以访问
+func Test_DebugHandlerRegisterHang(t *testing.T) {
+	backend := srvdiscovertest.NewMemoryBackend()
+	repo := backend.NewRepo(t, "")
+	//在恢复put和BeforeRegister之后关闭
+	httpServer := httptest.NewServer(repo.DebugHandler())
+	t.Cleanup(httpServer.Close)
+	reg, err := repo.AddRegistration(newPushGatewayInfo("push-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(reg.Key()) > 0
+	})
+
+	release := backend.HoldPut()
+	t.Cleanup(release)
+	reg.UpdateOnce()
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return backend.HeldPuts() == 1
+	})
+	unblock := make(chan struct{})
+	t.Cleanup(func() { close(unblock) })
+	_, err = repo.AddRegistration(newPushGatewayInfo("push-2"), srvDiscover.WithBeforeRegister(func(info *srvDiscover.RegisterInfo) {
+		<-unblock
+	}))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	for {
-		time.Sleep(time.Hour)
+	client := &http.Client{Timeout: 2 * time.Second}
+	resp, err := client.Get(httpServer.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var info srvDiscover.DebugInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.Registrations) != 2 || info.Registrations[0].Key != reg.Key() || info.Registrations[0].LastSaved == nil ||
+		info.Registrations[1].NodeId != "push-2" || len(info.Registrations[1].Key) != 0 {
+		t.Fatalf("unexpected registrations: %+v", info.Registrations)
+	}
+}
+
+// 查询指定前缀时阻塞直到release关闭, 不响应ctx
+type holdGetBackend struct {
+	*srvdiscovertest.MemoryBackend
+	prefix  string
+	release chan struct{}
+	held    atomic.Int64
+}
+
+func (this *holdGetBackend) GetPrefix(ctx context.Context, prefix string) ([]srvDiscover.KeyValue, int64, error) {
+	if prefix == this.prefix {
+		this.held.Add(1)
+		<-this.release
+	}
+	return this.MemoryBackend.GetPrefix(ctx, prefix)
+}
+
+func Test_DebugHandlerLicenseHang(t *testing.T) {
+	backend := &holdGetBackend{
+		MemoryBackend: srvdiscovertest.NewMemoryBackend(),
+		prefix:        srvDiscover.LIC_RESULT_KEY,
+		release:       make(chan struct{}),
+	}
+	repo := srvdiscovertest.NewRepoWithBackend(t, backend, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- repo.StartSubLicResultContext(ctx, "privkey", nil)
+	}()
+	t.Cleanup(func() {
+		close(backend.release)
+		cancel()
+		<-done
+	})
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return backend.held.Load() == 1
+	})
+
+	mustReturn(t, time.Second, "DebugInfo", func() {
+		repo.DebugInfo()
+	})
+	mustReturn(t, time.Second, "GetLicResultInfo", func() {
+		repo.GetLicResultInfo()
+	})
+}
+
+type lockedBuffer struct {
+	locker sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (this *lockedBuffer) Write(p []byte) (int, error) {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+	return this.buf.Write(p)
+}
+
+// 返回每行json日志
+func (this *lockedBuffer) records(t *testing.T) []map[string]any {
+	this.locker.Lock()
+	defer this.locker.Unlock()
+
+	var arr []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(this.buf.String()), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		record := make(map[string]any)
+		err := json.Unmarshal([]byte(line), &record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		arr = append(arr, record)
+	}
+	return arr
+}
+
+func findRecord(records []map[string]any, msg string) map[string]any {
+	for _, record := range records {
+		if record["msg"] == msg {
+			return record
+		}
+	}
+	return nil
+}
+
+func Test_WithLogger(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	output := new(lockedBuffer)
+	repo.WithLogger(slog.New(slog.NewJSONHandler(output, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	badKey := newPushGatewayInfo("push-bad").FormatRegisterKey(srvDiscover.DEFAULT_NAMESPACE)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = server.Client().Put(ctx, badKey, "not json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added, bad map[string]any
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		records := output.records(t)
+		added = findRecord(records, "add service node")
+		bad = findRecord(records, "decode service node failed")
+		return added != nil && bad != nil
+	})
+	if added["level"] != "DEBUG" || added[srvDiscover.LOG_KEY_SERVICE] != "PushGateway" || added[srvDiscover.LOG_KEY_NODE_ID] != "push-1" {
+		t.Fatalf("unexpected record: %v", added)
+	}
+	if bad["level"] != "WARN" || bad[srvDiscover.LOG_KEY_KEY] != badKey || bad[srvDiscover.LOG_KEY_ERROR] == nil {
+		t.Fatalf("unexpected record: %v", bad)
+	}
+}
+
+// KeepAlive返回nil channel和nil error
+type nilKeepaliveBackend struct {
+	*srvdiscovertest.MemoryBackend
+}
+
+func (this *nilKeepaliveBackend) KeepAlive(ctx context.Context, id srvDiscover.LeaseID) (<-chan struct{}, error) {
+	return nil, nil
+}
+
+func Test_KeepaliveNilChannelLog(t *testing.T) {
+	backend := &nilKeepaliveBackend{MemoryBackend: srvdiscovertest.NewMemoryBackend()}
+	repo := srvdiscovertest.NewRepoWithBackend(t, backend, "")
+	output := new(lockedBuffer)
+	repo.WithLogger(slog.New(slog.NewJSONHandler(output, nil)))
+
+	errs := make(chan error, 64)
+	_, err := repo.AddRegistration(newPushGatewayInfo("push-1"), srvDiscover.WithRegisterResultCallback(func(err error) {
+		if err != nil {
+			select {
+			case errs <- err:
+			default:
+			}
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-errs:
+		if err.Error() != "client KeepAlive error:keepalive channel is nil" {
+			t.Fatalf("unexpected result: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait keepalive result timeout")
+	}
+
+	var record map[string]any
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		record = findRecord(output.records(t), "lease keepalive channel is nil")
+		return record != nil
+	})
+	if record["level"] != "WARN" || record[srvDiscover.LOG_KEY_ERROR] != nil {
+		t.Fatalf("unexpected record: %v", record)
+	}
+	if findRecord(output.records(t), "lease keepalive failed") != nil {
+		t.Fatal("nil channel should not be logged as keepalive failed")
+	}
+}
+
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func findSpan(spans []sdktrace.ReadOnlySpan, name string) sdktrace.ReadOnlySpan {
+	for _, span := range spans {
+		if span.Name() == name {
+			return span
+		}
+	}
+	return nil
+}
+
+func Test_WithTracerProvider(t *testing.T) {
+	conf := loadConfFixture(t)
+
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, conf)
+	recorder := tracetest.NewSpanRecorder()
+	repo.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var grant, put, resync sdktrace.ReadOnlySpan
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		spans := recorder.Ended()
+		grant = findSpan(spans, "srvDiscover.Grant")
+		put = findSpan(spans, "srvDiscover.Put")
+		resync = nil
+		for _, span := range spans {
+			if span.Name() == "srvDiscover.Resync" && spanAttributes(span)[srvDiscover.ATTR_SERVICE].AsString() == "PushGateway" {
+				resync = span
+			}
+		}
+		return grant != nil && put != nil && resync != nil
+	})
+
+	if attrs := spanAttributes(grant); attrs[srvDiscover.ATTR_SERVICE].AsString() != "CallCenter" || attrs[srvDiscover.ATTR_NAMESPACE].AsString() != srvDiscover.DEFAULT_NAMESPACE {
+		t.Fatalf("unexpected grant attributes: %v", attrs)
+	}
+	if attrs := spanAttributes(put); attrs[srvDiscover.ATTR_SERVICE].AsString() != "CallCenter" || len(attrs[srvDiscover.ATTR_KEY].AsString()) == 0 ||
+		attrs[srvDiscover.ATTR_REVISION].AsInt64() == 0 {
+		t.Fatalf("unexpected put attributes: %v", attrs)
+	}
+	if attrs := spanAttributes(resync); attrs[srvDiscover.ATTR_REVISION].AsInt64() == 0 || attrs[srvDiscover.ATTR_NODE_COUNT].AsInt64() != 1 {
+		t.Fatalf("unexpected resync attributes: %v", attrs)
+	}
+}
+
+func Test_KeepAliveLostSpan(t *testing.T) {
+	backend := srvdiscovertest.NewMemoryBackend()
+	repo := backend.NewRepo(t, "")
+	recorder := tracetest.NewSpanRecorder()
+	repo.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	reg, err := repo.AddRegistration(newPushGatewayInfo("push-1"), srvDiscover.WithRegisterLeaseGroup("main"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(reg.Key()) > 0
+	})
+	kvs, _, err := backend.GetPrefix(context.Background(), reg.Key())
+	if err != nil || len(kvs) != 1 {
+		t.Fatalf("registration not found: %v", err)
+	}
+	backend.ExpireLease(kvs[0].Lease)
+
+	var lost sdktrace.ReadOnlySpan
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		lost = findSpan(recorder.Ended(), "srvDiscover.KeepAliveLost")
+		return lost != nil
+	})
+	attrs := spanAttributes(lost)
+	if attrs[srvDiscover.ATTR_SERVICE].AsString() != "PushGateway" || attrs[srvDiscover.ATTR_LEASE_GROUP].AsString() != "main" ||
+		attrs[srvDiscover.ATTR_NAMESPACE].AsString() != srvDiscover.DEFAULT_NAMESPACE {
+		t.Fatalf("unexpected keepalive lost attributes: %v", attrs)
+	}
+	if lost.Status().Code != codes.Error {
+		t.Fatalf("unexpected status: %v", lost.Status())
+	}
+}
+
+func Test_GetLicenseSpan(t *testing.T) {
+	backend := srvdiscovertest.NewMemoryBackend()
+	repo := backend.NewRepo(t, "")
+	recorder := tracetest.NewSpanRecorder()
+	repo.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	_, err := backend.Put(context.Background(), srvDiscover.LIC_RESULT_KEY, "invalid", srvDiscover.NoLease)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- repo.StartSubLicResultContext(ctx, "privkey", nil)
+	}()
+
+	var span sdktrace.ReadOnlySpan
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		span = findSpan(recorder.Ended(), "srvDiscover.GetLicense")
+		return span != nil
+	})
+	cancel()
+	<-done
+	attrs := spanAttributes(span)
+	if attrs[srvDiscover.ATTR_KEY].AsString() != srvDiscover.LIC_RESULT_KEY || attrs[srvDiscover.ATTR_REVISION].AsInt64() != 1 {
+		t.Fatalf("unexpected license attributes: %v", attrs)
+	}
+}
+
+const registerConf = `<SrvDiscover>
+    <Register>
+        <Global>
+            <Name>CallCenter</Name>
+            <Version>CallCenter-1.0.0</Version>
+            <PrivateIP>127.0.0.1</PrivateIP>
+        </Global>
+    </Register>
+    <Subscribe>
+        <Service>
+            <Name>PushGateway</Name>
+        </Service>
+    </Subscribe>
+</SrvDiscover>`
+
+// 等待repo的第一个注册项put成功, 返回其key
+func waitRegisteredKey(t *testing.T, server *srvdiscovertest.Server, repo *srvDiscover.Repo) string {
+	t.Helper()
+
+	var key string
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		regs := repo.Registrations()
+		if len(regs) == 0 {
+			return false
+		}
+		key = regs[0].Key()
+		return len(key) > 0 && len(server.Keys(t, key)) == 1
+	})
+	return key
+}
+
+func Test_StartRegisterContextCancel(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, registerConf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := repo.StartRegisterContext(ctx, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := waitRegisteredKey(t, server, repo)
+
+	cancel()
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(server.Keys(t, key)) == 0 && len(repo.Registrations()) == 0
+	})
+}
+
+func Test_StartSubscribeContextCancel(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	changes := make(chan srvDiscover.ServiceChange, 16)
+	cancelChange := repo.OnServiceChange("pushgateway", func(change srvDiscover.ServiceChange) {
+		changes <- change
+	})
+	defer cancelChange()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := repo.StartSubscribeContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-1"), 30)
+	if change := waitServiceChange(t, changes); len(change.Added) != 1 {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+
+	//ctx结束后同Unsubscribe删除订阅, 不再使用停止更新的缓存
+	cancel()
+	if change := waitServiceChange(t, changes); len(change.Removed) != 1 || change.Removed[0].Global.NodeId != "push-1" {
+		t.Fatalf("unexpected change: %+v", change)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.DebugInfo().Subscriptions) == 0
+	})
+	if infos := repo.GetServiceByName("PushGateway"); infos != nil {
+		t.Fatalf("stale nodes: %d", len(infos))
+	}
+
+	//可以重新订阅, 并同步到期间增加的节点
+	server.InjectRegistration(t, "", newPushGatewayInfo("push-2"), 30)
+	err = repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		subs := repo.DebugInfo().Subscriptions
+		return len(repo.GetServiceByName("PushGateway")) == 2 && len(subs) == 1 && subs[0].Watch.Connected
+	})
+	err = repo.Unsubscribe("PushGateway")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.Subscribe(srvDiscover.SubBasicInfo{Name: "PushGateway"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StartSubLicResultContextCancel(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- repo.StartSubLicResultContext(ctx, "privkey", nil)
+	}()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("license loop not stopped")
+	}
+}
+
+func Test_BindContextBeforeInit(t *testing.T) {
+	repo := new(srvDiscover.Repo)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if err := repo.WaitSynced(ctx); err == nil {
+		t.Fatal("expect error before init")
+	}
+	if err := repo.WaitForInstances(ctx, "PushGateway", 1); err == nil {
+		t.Fatal("expect error before init")
+	}
+}
+
+// 读取注册key的状态和修改版本
+func getRegisteredState(t *testing.T, server *srvdiscovertest.Server, key string) (string, int64) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := server.Client().Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", 0
+	}
+	info := new(srvDiscover.RegisterInfo)
+	err = info.Deserialize(resp.Kvs[0].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Global.State, resp.Kvs[0].ModRevision
+}
+
+func Test_RepoStateIsolated(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo1 := server.NewRepo(t, registerConf)
+	repo2 := server.NewRepo(t, strings.ReplaceAll(registerConf, "CallCenter", "Gateway"))
+	for _, repo := range []*srvDiscover.Repo{repo1, repo2} {
+		err := repo.StartRegister(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	key1 := waitRegisteredKey(t, server, repo1)
+	key2 := waitRegisteredKey(t, server, repo2)
+
+	repo1.ChangeState(srvDiscover.STATE_ONLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		state, _ := getRegisteredState(t, server, key1)
+		return state == srvDiscover.STATE_ONLINE
+	})
+	state2, revision2 := getRegisteredState(t, server, key2)
+	if state2 != srvDiscover.STATE_NOTREADY || repo2.GetState() != srvDiscover.STATE_NOTREADY {
+		t.Fatalf("repo2 state changed: %s %s", state2, repo2.GetState())
+	}
+
+	_, revision1 := getRegisteredState(t, server, key1)
+	repo1.UpdateOnce()
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		_, revision := getRegisteredState(t, server, key1)
+		return revision > revision1
+	})
+	//repo2没有强制更新, 不会被重新put
+	time.Sleep(1500 * time.Millisecond)
+	if _, revision := getRegisteredState(t, server, key2); revision != revision2 {
+		t.Fatalf("repo2 updated by repo1 UpdateOnce: %d -> %d", revision2, revision)
+	}
+}
+
+func Test_RegisterContextSharedState(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, nodeId := range []string{"push-1", "push-2"} {
+		go repo.RegisterContext(ctx, newPushGatewayInfo(nodeId))
+	}
+
+	var keys []string
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		keys = keys[:0]
+		for _, reg := range repo.Registrations() {
+			if len(reg.Key()) > 0 {
+				keys = append(keys, reg.Key())
+			}
+		}
+		return len(keys) == 2
+	})
+
+	//两个注册共用repo的状态, 修改后都要重新put
+	repo.ChangeState(srvDiscover.STATE_ONLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		for _, key := range keys {
+			state, _ := getRegisteredState(t, server, key)
+			if state != srvDiscover.STATE_ONLINE {
+				return false
+			}
+		}
+		return true
+	})
+
+	revisions := make([]int64, len(keys))
+	for idx, key := range keys {
+		_, revisions[idx] = getRegisteredState(t, server, key)
+	}
+	repo.UpdateOnce()
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		for idx, key := range keys {
+			_, revision := getRegisteredState(t, server, key)
+			if revision <= revisions[idx] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// 返回key绑定的lease
+func getKeyLease(t *testing.T, server *srvdiscovertest.Server, key string) int64 {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := server.Client().Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Kvs) == 0 {
+		return 0
+	}
+	return resp.Kvs[0].Lease
+}
+
+func Test_AddRegistration(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	reg, err := repo.AddRegistration(newPushGatewayInfo("push-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(reg.Key()) > 0 && len(server.Keys(t, reg.Key())) == 1
+	})
+	state, _ := getRegisteredState(t, server, reg.Key())
+	if state != srvDiscover.STATE_NOTREADY {
+		t.Fatalf("unexpected state: %s", state)
+	}
+
+	//每个注册项独立的状态, 不影响repo的状态
+	reg.ChangeState(srvDiscover.STATE_ONLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		state, _ := getRegisteredState(t, server, reg.Key())
+		return state == srvDiscover.STATE_ONLINE
+	})
+	if repo.GetState() != srvDiscover.STATE_NOTREADY {
+		t.Fatalf("repo state changed: %s", repo.GetState())
+	}
+}
+
+func Test_RegistrationLeaseGroup(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, "")
+
+	var regs []*srvDiscover.Registration
+	for _, nodeId := range []string{"push-1", "push-2"} {
+		reg, err := repo.AddRegistration(newPushGatewayInfo(nodeId), srvDiscover.WithRegisterLeaseGroup("main"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		regs = append(regs, reg)
+	}
+	alone, err := repo.AddRegistration(newPushGatewayInfo("push-3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	regs = append(regs, alone)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		for _, reg := range regs {
+			if len(reg.Key()) == 0 || getKeyLease(t, server, reg.Key()) == 0 {
+				return false
+			}
+		}
+		return true
+	})
+
+	lease1 := getKeyLease(t, server, regs[0].Key())
+	if lease2 := getKeyLease(t, server, regs[1].Key()); lease1 != lease2 {
+		t.Fatalf("same group uses different leases: %d %d", lease1, lease2)
+	}
+	if lease3 := getKeyLease(t, server, alone.Key()); lease3 == lease1 {
+		t.Fatalf("registration without group shares lease %d", lease3)
+	}
+
+	//移除一个成员只删除自己的key, 分组的lease继续续约
+	key1 := regs[0].Key()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = regs[0].Remove(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Keys(t, key1)) != 0 {
+		t.Fatalf("removed key still exists: %s", key1)
+	}
+	if getKeyLease(t, server, regs[1].Key()) != lease1 || len(server.Keys(t, alone.Key())) != 1 {
+		t.Fatal("other registrations are affected by Remove")
+	}
+	if len(repo.Registrations()) != 2 {
+		t.Fatalf("unexpected registrations: %d", len(repo.Registrations()))
+	}
+}
+
+// fn在timeout内返回, 否则测试失败
+func mustReturn(t *testing.T, timeout time.Duration, name string, fn func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fn()
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatalf("%s blocked", name)
+	}
+}
+
+func Test_RegistrationPutHang(t *testing.T) {
+	backend := srvdiscovertest.NewMemoryBackend()
+	repo := backend.NewRepo(t, "")
+	//在repo Close之前恢复, 注册协程才能退出
+	release := backend.HoldPut()
+	t.Cleanup(release)
+
+	reg, err := repo.AddRegistration(newPushGatewayInfo("push-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return backend.HeldPuts() == 1
+	})
+
+	//put无响应时句柄的方法不被阻塞
+	mustReturn(t, time.Second, "Key", func() {
+		if key := reg.Key(); len(key) != 0 {
+			t.Errorf("unexpected key: %s", key)
+		}
+	})
+	mustReturn(t, time.Second, "Info", func() {
+		if name := reg.Info().Global.Name; name != "PushGateway" {
+			t.Errorf("unexpected name: %s", name)
+		}
+	})
+	mustReturn(t, time.Second, "Remove", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		if err := reg.Remove(ctx); err != nil {
+			t.Errorf("remove failed: %v", err)
+		}
+	})
+	if len(repo.Registrations()) != 0 {
+		t.Fatalf("unexpected registrations: %d", len(repo.Registrations()))
+	}
+
+	//恢复后被移除的注册项不会再写入
+	release()
+	time.Sleep(100 * time.Millisecond)
+	kvs, _, err := backend.GetPrefix(context.Background(), "/registry.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kvs) != 0 {
+		t.Fatalf("removed registration is written: %s", kvs[0].Key)
+	}
+}
+
+func Test_RegistersConf(t *testing.T) {
+	conf := strings.Replace(registerConf, "    <Subscribe>", `    <Registers>
+        <Register>
+            <LeaseGroup>main</LeaseGroup>
+            <Global>
+                <Name>CallCenterAdmin</Name>
+                <Version>CallCenter-1.0.0</Version>
+                <PrivateIP>127.0.0.1</PrivateIP>
+            </Global>
+        </Register>
+    </Registers>
+    <Subscribe>`, 1)
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, conf)
+	err := repo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		regs := repo.Registrations()
+		return len(regs) == 2 && len(regs[0].Key()) > 0 && len(regs[1].Key()) > 0
+	})
+	regs := repo.Registrations()
+	if regs[0].Info().Global.Name != "CallCenter" || regs[1].Info().Global.Name != "CallCenterAdmin" {
+		t.Fatalf("unexpected registrations: %s %s", regs[0].Info().Global.Name, regs[1].Info().Global.Name)
+	}
+
+	//主注册项使用repo的状态, 额外注册项有独立的状态
+	repo.ChangeState(srvDiscover.STATE_ONLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		state, _ := getRegisteredState(t, server, regs[0].Key())
+		return state == srvDiscover.STATE_ONLINE
+	})
+	if state, _ := getRegisteredState(t, server, regs[1].Key()); state != srvDiscover.STATE_NOTREADY {
+		t.Fatalf("extra registration state changed: %s", state)
+	}
+}
+
+// 记录WatchPrefix使用的revision
+type recordWatchBackend struct {
+	*srvdiscovertest.MemoryBackend
+	locker    sync.Mutex
+	revisions []int64
+}
+
+func (this *recordWatchBackend) WatchPrefix(ctx context.Context, prefix string, revision int64) <-chan srvDiscover.WatchResponse {
+	this.locker.Lock()
+	this.revisions = append(this.revisions, revision)
+	this.locker.Unlock()
+	return this.MemoryBackend.WatchPrefix(ctx, prefix, revision)
+}
+
+func Test_MemoryBackend(t *testing.T) {
+	backend := &recordWatchBackend{MemoryBackend: srvdiscovertest.NewMemoryBackend()}
+	registerRepo := backend.NewRepo(t, registerConf)
+	registerRepo.ChangeState(srvDiscover.STATE_ONLINE)
+	err := registerRepo.StartRegister(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := ""
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		regs := registerRepo.Registrations()
+		if len(regs) == 1 {
+			key = regs[0].Key()
+		}
+		return len(key) > 0
+	})
+
+	subscribeRepo := srvdiscovertest.NewRepoWithBackend(t, backend, strings.ReplaceAll(subscribeConf, "PushGateway", "CallCenter"))
+	err = subscribeRepo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(subscribeRepo.GetServiceByName("CallCenter")) == 1
+	})
+
+	//从全量查询的下一个revision开始watch
+	_, revision, err := backend.GetPrefix(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend.locker.Lock()
+	revisions := append([]int64(nil), backend.revisions...)
+	backend.locker.Unlock()
+	if len(revisions) != 1 || revisions[0] <= 0 || revisions[0] > revision+1 {
+		t.Fatalf("unexpected watch revisions: %v, current revision:%d", revisions, revision)
+	}
+
+	//状态变化通过watch同步
+	registerRepo.ChangeState(srvDiscover.STATE_OFFLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(subscribeRepo.GetServiceByName("CallCenter")) == 0
+	})
+	registerRepo.ChangeState(srvDiscover.STATE_ONLINE)
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(subscribeRepo.GetServiceByName("CallCenter")) == 1
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = registerRepo.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(subscribeRepo.GetServiceByName("CallCenter")) == 0
+	})
+}
+
+// 启动接受连接后立即关闭的监听并注册为PushGateway节点, 返回节点id对应的地址
+func startNodeListeners(t *testing.T, server *srvdiscovertest.Server, nodeIds ...string) map[string]string {
+	addrs := make(map[string]string)
+	for _, nodeId := range nodeIds {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = listener.Close() })
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				_ = conn.Close()
+			}
+		}()
+		addrs[nodeId] = listener.Addr().String()
+		server.InjectRegistration(t, "", newRestfulInfo(nodeId, addrs[nodeId]), 30)
+	}
+	return addrs
+}
+
+func Test_DialContextSpread(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	startNodeListeners(t, server, "push-1", "push-2", "push-3")
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 3
+	})
+
+	//每次连接只选一个节点, 连接均匀分布到所有节点
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts := make(map[string]int)
+	for i := 0; i < 9; i++ {
+		conn, err := repo.DialContext(ctx, "tcp", "PushGateway:restful")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[conn.RemoteAddr().String()]++
+		_ = conn.Close()
+	}
+	if len(counts) != 3 {
+		t.Fatalf("connections not spread: %v", counts)
+	}
+	for addr, count := range counts {
+		if count != 3 {
+			t.Fatalf("unexpected connections to %s: %v", addr, counts)
+		}
+	}
+}
+
+func Test_DialContextHint(t *testing.T) {
+	server := srvdiscovertest.StartServer(t)
+	repo := server.NewRepo(t, subscribeConf)
+	err := repo.StartSubscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = repo.SetPicker("PushGateway", srvDiscover.NewConsistentHashPicker(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs := startNodeListeners(t, server, "push-1", "push-2", "push-3")
+	srvdiscovertest.Eventually(t, 5*time.Second, func() bool {
+		return len(repo.GetServiceByName("PushGateway")) == 3
+	})
+	inflight := func(nodeId string) int64 {
+		for _, node := range repo.DebugInfo().Subscriptions[0].Nodes {
+			if node.NodeId == nodeId {
+				return node.InFlight
+			}
+		}
+		return -1
+	}
+
+	//相同hint的连接都发往同一个节点, 连接关闭前记为进行中请求
+	_, expect := repo.GetServiceByHashKey("PushGateway", "call-1")
+	ctx, cancel := context.WithTimeout(srvDiscover.WithPickHint(context.Background(), "call-1"), 5*time.Second)
+	defer cancel()
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		conn, err := repo.DialContext(ctx, "tcp", "PushGateway:restful")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+		if conn.RemoteAddr().String() != addrs[expect.Global.NodeId] {
+			t.Fatalf("hint sent to %s, expect %s", conn.RemoteAddr(), addrs[expect.Global.NodeId])
+		}
+	}
+	if count := inflight(expect.Global.NodeId); count != 3 {
+		t.Fatalf("unexpected inflight %d", count)
+	}
+	for _, conn := range conns {
+		_ = conn.Close()
+		_ = conn.Close()
+	}
+	if count := inflight(expect.Global.NodeId); count != 0 {
+		t.Fatalf("inflight not released: %d", count)
 	}
 }